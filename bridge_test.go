@@ -2,61 +2,33 @@ package gozargah_node_bridge
 
 import (
 	"context"
-	"fmt"
-
-	"log"
-	"os"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	"github.com/pasarguard/node_bridge/common"
-	"github.com/pasarguard/node_bridge/tools"
-)
-
-var (
-	nodeAddr   = "172.27.158.135"
-	serverCA   = "certs/ssl_cert.pem"
-	apiKey     = "d04d8680-942d-4365-992f-9f482275691d"
-	configPath = "config/xray.json"
-	keepAlive  = uint64(60)
+	"github.com/pasarguard/node_bridge/controller"
+	"github.com/pasarguard/node_bridge/metrics"
+	"github.com/pasarguard/node_bridge/nodetest"
+	"github.com/pasarguard/node_bridge/tracing"
 )
 
 var (
-	serverCAFile []byte
-	uuidKey      uuid.UUID
-	configFile   string
-	opts         []NodeOption
+	nodeAddr  = "127.0.0.1"
+	config    = `{"inbounds": [], "outbounds": []}`
+	keepAlive = uint64(60)
+	protocols = []NodeProtocol{GRPC, REST}
 )
 
-func init() {
-	var err error
-	serverCAFile, err = os.ReadFile(serverCA)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	uuidKey, err = uuid.Parse(apiKey)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	configFile, err = tools.ReadFileAsString(configPath)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	opts = []NodeOption{
-		WithPort(2096),
-		WithAPIKey(uuidKey),
-		WithServerCA(serverCAFile),
-		WithLogChannelSize(100),
-	}
-}
-
 var user = common.CreateUser(
 	"test_user",
 	common.CreateProxies(
@@ -67,95 +39,779 @@ var user = common.CreateUser(
 		nil,
 		nil,
 	),
-	[]string{},
+	[]string{"vmess-in"},
 )
 
-func TestGrpcNode(t *testing.T) {
-	node, err := New(nodeAddr, GRPC, opts...)
+// forEachProtocol runs test as a subtest for each protocol
+func forEachProtocol(t *testing.T, test func(t *testing.T, protocol NodeProtocol)) {
+	for _, protocol := range protocols {
+		t.Run(string(protocol), func(t *testing.T) { test(t, protocol) })
+	}
+}
+
+// startTestNode starts a test node that is stopped once the test ends
+func startTestNode(t *testing.T, protocol NodeProtocol, options ...NodeOption) (PasarGuardNode, *nodetest.Server) {
+	t.Helper()
+	node, server := newTestNode(t, protocol, options...)
+	if err := node.Start(config, common.BackendType_XRAY, nil, keepAlive); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(node.Stop)
+	return node, server
+}
+
+func newTestNode(t *testing.T, protocol NodeProtocol, options ...NodeOption) (PasarGuardNode, *nodetest.Server) {
+	t.Helper()
+	server, port := serveTestNode(t, protocol)
+	return connectTestNode(t, server, port, protocol, options...), server
+}
+
+// serveTestNode starts a fake node serving protocol and returns its port
+func serveTestNode(t *testing.T, protocol NodeProtocol) (*nodetest.Server, int) {
+	t.Helper()
+
+	server, err := nodetest.New(uuid.New())
 	if err != nil {
 		t.Fatal(err)
 	}
+	t.Cleanup(server.Close)
 
-	if err = node.Start(configFile, common.BackendType_XRAY, nil, keepAlive); err != nil {
+	var port int
+	switch protocol {
+	case GRPC:
+		port, err = server.ServeGRPC()
+	case REST:
+		port, err = server.ServeREST()
+	}
+	if err != nil {
 		t.Fatal(err)
 	}
+	return server, port
+}
 
-	defer node.Stop()
+// connectTestNode creates another node talking to an already serving server
+func connectTestNode(t *testing.T, server *nodetest.Server, port int, protocol NodeProtocol, options ...NodeOption) PasarGuardNode {
+	t.Helper()
+
+	opts := append([]NodeOption{
+		WithPort(port),
+		WithAPIKey(server.APIKey),
+		WithServerCA(server.CertPEM),
+		WithLogChannelSize(100),
+	}, options...)
 
-	info, err := node.Info()
+	node, err := New(nodeAddr, protocol, opts...)
 	if err != nil {
 		t.Fatal(err)
 	}
-	fmt.Printf("%+v\n", info)
+	return node
+}
 
-	node.UpdateUsers([]*common.User{user})
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
 
-	_, err = node.GetUserOnlineIpList("does-not-exist@example.com")
-	st, _ := status.FromError(err)
-	fmt.Printf("online ip list status: %+v\n", st)
-	if st.Code() != codes.NotFound {
-		t.Fatalf("Failed to get users stats: %v", err)
+// waitHealth reads events until the node turned health
+func waitHealth(t *testing.T, events <-chan controller.HealthEvent, health controller.Health) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Current == health {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for the node to turn %v", health)
+		}
 	}
+}
+
+func TestNode(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		node, server := startTestNode(t, protocol)
+
+		if node.Health() != controller.Healthy {
+			t.Fatalf("expected healthy node, got %v", node.Health())
+		}
+		if node.NodeVersion() != nodetest.NodeVersion || node.CoreVersion() != nodetest.CoreVersion {
+			t.Fatalf("unexpected versions %q %q", node.NodeVersion(), node.CoreVersion())
+		}
+
+		info, err := node.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.GetStarted() {
+			t.Fatal("expected node to report started")
+		}
+
+		node.UpdateUsers([]*common.User{user})
+		waitFor(t, 2*time.Second, func() bool {
+			_, ok := server.User(user.GetEmail())
+			return ok
+		})
+
+		syncCtx, syncCancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer syncCancel()
+		if err = node.RemoveUsers(user.GetEmail()).Wait(syncCtx); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := server.User(user.GetEmail()); ok {
+			t.Fatal("expected user to be removed")
+		}
+		if err = node.UpdateUsers([]*common.User{user}).Wait(syncCtx); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := server.User(user.GetEmail()); !ok {
+			t.Fatal("expected user to be added back")
+		}
+
+		if _, err = node.GetSystemStats(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = node.GetBackendStats(); err != nil {
+			t.Fatal(err)
+		}
+
+		server.AddUserTraffic(user.GetEmail(), 10, 20)
+		stats, err := node.GetStats(true, "", common.StatType_UsersStat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats.GetStats()) != 2 {
+			t.Fatalf("expected 2 user stats, got %d", len(stats.GetStats()))
+		}
+		stats, err = node.GetStats(false, user.GetEmail(), common.StatType_UserStat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stat := range stats.GetStats() {
+			if stat.GetValue() != 0 {
+				t.Fatalf("expected stats to be reset, got %+v", stat)
+			}
+		}
+
+		if _, err = node.GetUserOnlineIpList("does-not-exist@example.com"); err == nil {
+			t.Fatal("expected error for unknown user")
+		}
+		if st, ok := status.FromError(err); protocol == GRPC && (!ok || st.Code() != codes.NotFound) {
+			t.Fatalf("expected NotFound, got %v", err)
+		}
 
-	go func() {
-		logChan, err := node.StreamLogs(context.Background())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		logChan, err := node.StreamLogs(ctx)
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		for entry := range logChan {
+		waitFor(t, 2*time.Second, func() bool { return server.LogSubscribers() == 1 })
+		server.PushLog("hello from nodetest")
+
+		select {
+		case entry := <-logChan:
 			if entry.Err != nil {
-				t.Log(entry.Err)
-				return
+				t.Fatal(entry.Err)
+			}
+			if entry.Line != "hello from nodetest" {
+				t.Fatalf("unexpected log line %q", entry.Line)
 			}
-			fmt.Println(entry.Line)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for log line")
+		}
+	})
+}
+
+func TestNodeInjectedFailure(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		node, server := newTestNode(t, protocol)
+
+		server.SetFailure(nodetest.MethodStart, errors.New("boom"))
+		if err := node.Start(config, common.BackendType_XRAY, nil, keepAlive); err == nil {
+			t.Fatal("expected start to fail")
+		}
+		if node.Health() != controller.NotConnected {
+			t.Fatalf("expected not connected node, got %v", node.Health())
+		}
+
+		server.ClearFailure(nodetest.MethodStart)
+		if err := node.Start(config, common.BackendType_XRAY, []*common.User{user}, keepAlive); err != nil {
+			t.Fatal(err)
+		}
+		defer node.Stop()
+
+		if len(server.Users()) != 1 {
+			t.Fatalf("expected start users to reach the node, got %d", len(server.Users()))
+		}
+
+		server.SetFailure(nodetest.MethodGetStats, errors.New("boom"))
+		if _, err := node.GetStats(false, "", common.StatType_Outbounds); err == nil {
+			t.Fatal("expected get stats to fail")
 		}
-	}()
 
-	time.Sleep(2 * time.Second)
+		node.Stop()
+		if server.Started() {
+			t.Fatal("expected node to be stopped")
+		}
+	})
 }
 
-func TestRestNode(t *testing.T) {
-	node, err := New(nodeAddr, REST, opts...)
-	if err != nil {
-		t.Fatal(err)
+func TestNodeHealthCheck(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		node, server := startTestNode(t, protocol, WithHealthCheck(20*time.Millisecond, 2, 2))
+
+		waitFor(t, 2*time.Second, func() bool { return !node.LastHealthCheck().IsZero() })
+
+		server.SetFailure(nodetest.MethodGetBaseInfo, errors.New("node is gone"))
+		waitFor(t, 2*time.Second, func() bool { return node.Health() == controller.Broken })
+		if node.LastHealthError() == nil {
+			t.Fatal("expected last health error to be set")
+		}
+
+		server.ClearFailure(nodetest.MethodGetBaseInfo)
+		waitFor(t, 2*time.Second, func() bool { return node.Health() == controller.Healthy })
+		if err := node.LastHealthError(); err != nil {
+			t.Fatalf("expected last health error to be cleared, got %v", err)
+		}
+	})
+}
+
+func TestNodeHealthEvents(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		node, server := newTestNode(t, protocol, WithHealthCheck(20*time.Millisecond, 1, 1))
+
+		events, unsubscribe := node.SubscribeHealth(10)
+		defer unsubscribe()
+
+		next := func() controller.HealthEvent {
+			t.Helper()
+			select {
+			case ev := <-events:
+				return ev
+			case <-time.After(2 * time.Second):
+				t.Fatal("timed out waiting for health event")
+				return controller.HealthEvent{}
+			}
+		}
+
+		server.SetFailure(nodetest.MethodStart, errors.New("boom"))
+		_ = node.Start(config, common.BackendType_XRAY, nil, keepAlive)
+		if ev := next(); ev.Reason != controller.ReasonStartFailed || ev.Err == nil {
+			t.Fatalf("expected start failure event, got %+v", ev)
+		}
+
+		server.ClearFailure(nodetest.MethodStart)
+		if err := node.Start(config, common.BackendType_XRAY, nil, keepAlive); err != nil {
+			t.Fatal(err)
+		}
+		if ev := next(); ev.Current != controller.Healthy || ev.Reason != controller.ReasonConnected {
+			t.Fatalf("expected connected event, got %+v", ev)
+		}
+
+		server.SetFailure(nodetest.MethodGetBaseInfo, errors.New("node is gone"))
+		if ev := next(); ev.Current != controller.Broken || ev.Reason != controller.ReasonHealthCheckFailed {
+			t.Fatalf("expected health check failure event, got %+v", ev)
+		}
+
+		node.Stop()
+		if ev := next(); ev.Current != controller.NotConnected || ev.Reason != controller.ReasonDisconnected {
+			t.Fatalf("expected disconnected event, got %+v", ev)
+		}
+	})
+}
+
+func TestNodeSupervisor(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		node, server := newTestNode(t, protocol,
+			WithHealthCheck(20*time.Millisecond, 1, 1),
+			WithSupervisor(10*time.Millisecond, 50*time.Millisecond, 0.5, 0),
+		)
+
+		events, unsubscribe := node.SubscribeHealth(32)
+		defer unsubscribe()
+
+		if err := node.Start(config, common.BackendType_XRAY, []*common.User{user}, keepAlive); err != nil {
+			t.Fatal(err)
+		}
+		defer node.Stop()
+
+		added := common.CreateUser("added_user", user.GetProxies(), []string{"vmess-in"})
+		node.UpdateUsers([]*common.User{added})
+		waitFor(t, 2*time.Second, func() bool { return len(server.Users()) == 2 })
+
+		server.SetFailure(nodetest.MethodStart, errors.New("still down"))
+		server.Crash()
+
+		waitFor(t, 2*time.Second, func() bool { return server.Calls(nodetest.MethodStart) >= 3 })
+		server.ClearFailure(nodetest.MethodStart)
+
+		deadline := time.After(3 * time.Second)
+		var last controller.HealthEvent
+		for recovered := false; !recovered; {
+			select {
+			case ev := <-events:
+				if recovered = ev.Reason == controller.ReasonRecovered; recovered {
+					if ev.Previous != last.Previous || ev.Current != last.Current {
+						t.Fatalf("expected the recovery to repeat the transition %v -> %v, got %v -> %v",
+							last.Previous, last.Current, ev.Previous, ev.Current)
+					}
+				}
+				last = ev
+			case <-deadline:
+				t.Fatal("timed out waiting for recovery event")
+			}
+		}
+
+		if node.Health() != controller.Healthy || !server.Started() {
+			t.Fatalf("expected node to be running again, got %v", node.Health())
+		}
+		if len(server.Users()) != 2 {
+			t.Fatalf("expected users to be replayed, got %d", len(server.Users()))
+		}
+		if server.Backend().GetConfig() != config {
+			t.Fatal("expected the last backend config to be replayed")
+		}
+	})
+}
+
+func TestNodeSupervisorStop(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		node, server := newTestNode(t, protocol,
+			WithHealthCheck(20*time.Millisecond, 1, 1),
+			WithSupervisor(10*time.Millisecond, 50*time.Millisecond, 0, 0),
+		)
+		if err := node.Start(config, common.BackendType_XRAY, nil, keepAlive); err != nil {
+			t.Fatal(err)
+		}
+
+		// Stopped while the supervisor restarts the node. Stop waits for the
+		// restart in flight, which stops the node again once it is cancelled.
+		server.SetDelay(nodetest.MethodStart, 50*time.Millisecond)
+		server.Crash()
+		waitFor(t, 2*time.Second, func() bool { return server.Calls(nodetest.MethodStart) >= 2 })
+		node.Stop()
+
+		if node.Health() != controller.NotConnected || server.Started() {
+			t.Fatalf("expected the node to stay stopped, got %v", node.Health())
+		}
+	})
+}
+
+func TestNodeContext(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		node, server := newTestNode(t, protocol)
+
+		if err := node.StartContext(context.Background(), config, common.BackendType_XRAY, nil, keepAlive); err != nil {
+			t.Fatal(err)
+		}
+		defer node.Stop()
+
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-trace-id", "trace-1")
+		if _, err := node.InfoContext(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got := server.Metadata(nodetest.MethodGetBaseInfo).Get("x-trace-id"); len(got) != 1 || got[0] != "trace-1" {
+			t.Fatalf("expected trace metadata to reach the node, got %v", got)
+		}
+
+		server.SetDelay(nodetest.MethodGetSystemStats, time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		started := time.Now()
+		if _, err := node.GetSystemStatsContext(ctx); err == nil {
+			t.Fatal("expected deadline to abort the call")
+		}
+		if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+			t.Fatalf("expected call to honor the caller deadline, took %v", elapsed)
+		}
+	})
+}
+
+func TestNodeConcurrentRestart(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		node, _ := startTestNode(t, protocol)
+
+		// Calls made while the node restarts are cancelled or served
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					_, _ = node.InfoContext(context.Background())
+				}
+			}()
+		}
+		for range 5 {
+			if err := node.Start(config, common.BackendType_XRAY, nil, keepAlive); err != nil {
+				t.Fatal(err)
+			}
+		}
+		close(done)
+		wg.Wait()
+	})
+}
+
+func TestNodeTimeouts(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		node, server := startTestNode(t, protocol, WithTimeouts(controller.Timeouts{
+			Unary: 50 * time.Millisecond,
+			Sync:  50 * time.Millisecond,
+		}))
+
+		server.SetDelay(nodetest.MethodGetStats, time.Second)
+		started := time.Now()
+		if _, err := node.GetStats(false, "", common.StatType_Inbounds); err == nil {
+			t.Fatal("expected unary timeout")
+		}
+		if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+			t.Fatalf("expected unary timeout to apply, took %v", elapsed)
+		}
+
+		server.SetDelay(nodetest.MethodSyncUsersChunked, time.Second)
+		if err := node.SyncUsers([]*common.User{user}); err == nil {
+			t.Fatal("expected sync timeout")
+		}
+
+		server.SetDelay(nodetest.MethodSyncUsersChunked, 0)
+		if err := node.SyncUsers([]*common.User{user}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestNodeReconcile(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		node, server := newTestNode(t, protocol,
+			WithHealthCheck(20*time.Millisecond, 1, 1),
+			WithReconcile(0),
+		)
+		events, unsubscribe := node.SubscribeHealth(16)
+		defer unsubscribe()
+
+		if err := node.Start(config, common.BackendType_XRAY, []*common.User{user}, keepAlive); err != nil {
+			t.Fatal(err)
+		}
+		defer node.Stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		added := common.CreateUser("added_user", user.GetProxies(), []string{"vmess-in"})
+		if err := node.UpdateUsers([]*common.User{added}).Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		// The node restarts by itself and comes back without users
+		server.Crash()
+		waitHealth(t, events, controller.Broken)
+		server.Restart()
+		waitHealth(t, events, controller.Healthy)
+		waitFor(t, 2*time.Second, func() bool { return len(server.Users()) == 2 })
+
+		server.Restart()
+		if err := node.Reconcile(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if len(server.Users()) != 2 {
+			t.Fatalf("expected users to be pushed again, got %d", len(server.Users()))
+		}
+	})
+}
+
+func TestNodeSkipUnchanged(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		node, server := startTestNode(t, protocol, WithSyncPolicy(controller.SyncPolicy{SkipUnchanged: true}))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		for range 3 {
+			if err := node.UpdateUsers([]*common.User{user}).Wait(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if calls := server.Calls(nodetest.MethodSyncUsersChunked); calls != 1 {
+			t.Fatalf("expected a single sync call, got %d", calls)
+		}
+		if stats := node.SyncStats(); stats.Skipped != 2 || stats.Delivered != 1 {
+			t.Fatalf("unexpected sync stats %+v", stats)
+		}
+	})
+}
+
+func TestNodePendingStore(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		path := filepath.Join(t.TempDir(), "pending.log")
+		store, err := controller.NewFilePendingStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server, port := serveTestNode(t, protocol)
+		node := connectTestNode(t, server, port, protocol, WithPendingStore(store))
+		if err = node.Start(config, common.BackendType_XRAY, nil, keepAlive); err != nil {
+			t.Fatal(err)
+		}
+
+		// The update can't be delivered before the process goes away
+		server.SetFailure(nodetest.MethodSyncUsersChunked, errors.New("node is busy"))
+		node.UpdateUsers([]*common.User{user})
+		waitFor(t, 2*time.Second, func() bool { return server.Calls(nodetest.MethodSyncUsersChunked) > 0 })
+		node.Stop()
+		if err = store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		server.ClearFailure(nodetest.MethodSyncUsersChunked)
+
+		store, err = controller.NewFilePendingStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		node = connectTestNode(t, server, port, protocol, WithPendingStore(store))
+		if err = node.Start(config, common.BackendType_XRAY, nil, keepAlive); err != nil {
+			t.Fatal(err)
+		}
+		defer node.Stop()
+
+		waitFor(t, 2*time.Second, func() bool {
+			_, ok := server.User(user.GetEmail())
+			return ok
+		})
+		waitFor(t, 2*time.Second, func() bool { return store.Len() == 0 })
+	})
+}
+
+func TestNodeMetrics(t *testing.T) {
+	codes := map[NodeProtocol]string{GRPC: "Internal", REST: "500"}
+
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		registry := metrics.New()
+		node, server := startTestNode(t, protocol, WithMetrics(registry, "node-1"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := node.UpdateUsers([]*common.User{user}).Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		server.SetFailure(nodetest.MethodGetStats, errors.New("boom"))
+		if _, err := node.GetStats(false, "", common.StatType_UsersStat); err == nil {
+			t.Fatal("expected injected failure")
+		}
+
+		var b strings.Builder
+		if _, err := registry.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		out := b.String()
+		for _, line := range []string{
+			`pasarguard_bridge_requests_total{node="node-1",operation="Start"} 1`,
+			`pasarguard_bridge_requests_total{node="node-1",operation="SyncUsers"} 1`,
+			`pasarguard_bridge_request_errors_total{node="node-1",operation="GetStats",code="` + codes[protocol] + `"} 1`,
+			`pasarguard_bridge_sync_queue_depth{node="node-1"} 0`,
+		} {
+			if !strings.Contains(out, line+"\n") {
+				t.Errorf("missing %q in output:\n%s", line, out)
+			}
+		}
+	})
+}
+
+type testSpan struct {
+	name   string
+	attrs  map[string]any
+	events []string
+	err    error
+	ended  bool
+}
+
+func (s *testSpan) SetAttributes(attrs ...tracing.Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
 	}
+}
 
-	if err = node.Start(configFile, common.BackendType_XRAY, nil, keepAlive); err != nil {
-		t.Fatal(err)
+func (s *testSpan) AddEvent(name string, attrs ...tracing.Attribute) {
+	s.events = append(s.events, name)
+}
+
+func (s *testSpan) RecordError(err error) { s.err = err }
+func (s *testSpan) End()                  { s.ended = true }
+
+// testTracer records spans and propagates the span name as traceparent
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+type spanKey struct{}
+
+func (t *testTracer) Start(ctx context.Context, name string, attrs ...tracing.Attribute) (context.Context, tracing.Span) {
+	span := &testSpan{name: name, attrs: make(map[string]any)}
+	span.SetAttributes(attrs...)
+
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (t *testTracer) Inject(ctx context.Context, set func(key, value string)) {
+	if span, ok := ctx.Value(spanKey{}).(*testSpan); ok {
+		set("traceparent", span.name)
 	}
+}
 
-	defer node.Stop()
+func (t *testTracer) find(method string) *testSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, span := range t.spans {
+		if m, _ := span.attrs[tracing.KeyMethod].(string); strings.HasSuffix(m, method) {
+			return span
+		}
+	}
+	return nil
+}
 
-	info, err := node.Info()
-	if err != nil {
-		t.Fatal(err)
+func TestNodeTracing(t *testing.T) {
+	methods := map[NodeProtocol][2]string{
+		GRPC: {"/service.NodeService/GetBaseInfo", "/service.NodeService/SyncUsersChunked"},
+		REST: {"GET /info", "PUT /users/sync/chunked"},
 	}
-	fmt.Printf("%+v\n", info)
 
-	node.UpdateUsers([]*common.User{user})
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		tracer := &testTracer{}
+		node, server := startTestNode(t, protocol, WithTracer(tracer), WithSyncPolicy(controller.SyncPolicy{ChunkSize: 1}))
+
+		if _, err := node.Info(); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		added := common.CreateUser("added_user", user.GetProxies(), []string{"vmess-in"})
+		if err := node.UpdateUsers([]*common.User{user, added}).Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		info := tracer.find(methods[protocol][0])
+		if info == nil || !info.ended {
+			t.Fatalf("expected an ended span for %s", methods[protocol][0])
+		}
+		if info.attrs[tracing.KeyProtocol] != strings.ToLower(string(protocol)) || info.attrs[tracing.KeyServerAddress] == nil {
+			t.Fatalf("missing base attributes %v", info.attrs)
+		}
+		if got := server.Metadata(nodetest.MethodGetBaseInfo).Get("traceparent"); len(got) != 1 || got[0] != info.name {
+			t.Fatalf("expected trace context to reach the node, got %v", got)
+		}
+
+		syncSpan := tracer.find(methods[protocol][1])
+		if syncSpan == nil || !syncSpan.ended {
+			t.Fatalf("expected an ended span for %s", methods[protocol][1])
+		}
+		if syncSpan.attrs[tracing.KeyUserCount] != 2 || syncSpan.attrs[tracing.KeyChunkCount] != 2 {
+			t.Fatalf("missing sync attributes %v", syncSpan.attrs)
+		}
+		if len(syncSpan.events) != 2 || syncSpan.events[0] != tracing.EventChunk {
+			t.Fatalf("expected an event per chunk, got %v", syncSpan.events)
+		}
+	})
+}
+
+func TestNodeLogger(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		var mu sync.Mutex
+		var buf strings.Builder
+		logger := slog.New(slog.NewTextHandler(writerFunc(func(p []byte) (int, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return buf.Write(p)
+		}), nil))
+
+		node, _ := newTestNode(t, protocol, WithLogger(logger))
+		if err := node.Start(config, common.BackendType_XRAY, nil, keepAlive); err != nil {
+			t.Fatal(err)
+		}
+		node.Stop()
 
-	go func() {
-		logChan, err := node.StreamLogs(context.Background())
+		mu.Lock()
+		defer mu.Unlock()
+		out := buf.String()
+		for _, want := range []string{"reason=connected", "reason=disconnected", "node=127.0.0.1:", "protocol=" + string(protocol)} {
+			if !strings.Contains(out, want) {
+				t.Errorf("missing %q in log output:\n%s", want, out)
+			}
+		}
+	})
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestNodeLogReconnect(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, protocol NodeProtocol) {
+		node, server := startTestNode(t, protocol)
+
+		logChan, err := node.StreamLogs(context.Background(), controller.WithLogReconnect(controller.LogReconnect{InitialBackoff: 10 * time.Millisecond}))
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		for entry := range logChan {
-			if entry.Err != nil {
-				t.Log(entry.Err)
-				return
+		next := func() controller.LogEntry {
+			t.Helper()
+			select {
+			case entry, ok := <-logChan:
+				if !ok {
+					t.Fatal("log channel closed")
+				}
+				return entry
+			case <-time.After(2 * time.Second):
+				t.Fatal("timed out waiting for log entry")
 			}
-			fmt.Println(entry.Line)
+			return controller.LogEntry{}
 		}
-	}()
 
-	time.Sleep(3 * time.Second)
+		waitFor(t, 2*time.Second, func() bool { return server.LogSubscribers() == 1 })
+		server.PushLog("before")
+		if entry := next(); entry.Line != "before" {
+			t.Fatalf("unexpected entry %+v", entry)
+		}
 
-	stats, err := node.GetStats(true, "", common.StatType_Outbounds)
-	if err != nil {
-		t.Fatal(err)
-	}
+		server.CloseLogStreams()
+		if entry := next(); entry.Gap <= 0 || entry.Err != nil {
+			t.Fatalf("expected a gap marker, got %+v", entry)
+		}
+		waitFor(t, 2*time.Second, func() bool { return server.LogSubscribers() == 1 })
+		server.PushLog("after")
+		if entry := next(); entry.Line != "after" {
+			t.Fatalf("unexpected entry %+v", entry)
+		}
 
-	for _, stat := range stats.GetStats() {
-		fmt.Printf("%+v\n", stat)
-	}
+		node.Stop()
+		select {
+		case _, ok := <-logChan:
+			if ok {
+				t.Fatal("expected the log channel to be closed on Stop")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("log channel not closed on Stop")
+		}
+	})
 }
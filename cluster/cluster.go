@@ -0,0 +1,215 @@
+// Package cluster manages a named set of nodes and fans operations out to
+// all of them concurrently.
+package cluster
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	bridge "github.com/pasarguard/node_bridge"
+	"github.com/pasarguard/node_bridge/common"
+	"github.com/pasarguard/node_bridge/controller"
+)
+
+const DefaultConcurrency = 16
+
+var (
+	ErrNodeExists   = errors.New("node already exists")
+	ErrNodeNotFound = errors.New("node not found")
+)
+
+// Result holds the outcome of a fan-out call on a single node
+type Result[T any] struct {
+	Value T
+	Err   error
+}
+
+// HealthSummary groups node names by their current health
+type HealthSummary struct {
+	Healthy      []string
+	Broken       []string
+	NotConnected []string
+}
+
+func (s HealthSummary) Total() int {
+	return len(s.Healthy) + len(s.Broken) + len(s.NotConnected)
+}
+
+type Cluster struct {
+	nodes       map[string]bridge.PasarGuardNode
+	concurrency int
+	mu          sync.RWMutex
+}
+
+// New creates an empty cluster running at most concurrency calls at a time.
+// A concurrency of zero or less uses DefaultConcurrency.
+func New(concurrency int) *Cluster {
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	return &Cluster{
+		nodes:       make(map[string]bridge.PasarGuardNode),
+		concurrency: concurrency,
+	}
+}
+
+// Add registers an existing node under name
+func (c *Cluster) Add(name string, node bridge.PasarGuardNode) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.nodes[name]; ok {
+		return ErrNodeExists
+	}
+	c.nodes[name] = node
+	return nil
+}
+
+// AddNode creates a node with bridge.New and registers it under name
+func (c *Cluster) AddNode(name, address string, protocol bridge.NodeProtocol, options ...bridge.NodeOption) (bridge.PasarGuardNode, error) {
+	node, err := bridge.New(address, protocol, options...)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Add(name, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// Remove unregisters a node and returns it. The node is not stopped.
+func (c *Cluster) Remove(name string) (bridge.PasarGuardNode, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node, ok := c.nodes[name]
+	delete(c.nodes, name)
+	return node, ok
+}
+
+func (c *Cluster) Node(name string) (bridge.PasarGuardNode, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	node, ok := c.nodes[name]
+	return node, ok
+}
+
+// Names returns the registered node names, sorted
+func (c *Cluster) Names() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	names := make([]string, 0, len(c.nodes))
+	for name := range c.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Cluster) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.nodes)
+}
+
+// UpdateUsers queues users on every node and returns their tickets by node name
+func (c *Cluster) UpdateUsers(users []*common.User) map[string]*controller.SyncTicket {
+	return tickets(fanOut(c, func(node bridge.PasarGuardNode) (*controller.SyncTicket, error) {
+		return node.UpdateUsers(users), nil
+	}))
+}
+
+// RemoveUsers queues user removals on every node and returns their tickets by node name
+func (c *Cluster) RemoveUsers(emails ...string) map[string]*controller.SyncTicket {
+	return tickets(fanOut(c, func(node bridge.PasarGuardNode) (*controller.SyncTicket, error) {
+		return node.RemoveUsers(emails...), nil
+	}))
+}
+
+func tickets(results map[string]Result[*controller.SyncTicket]) map[string]*controller.SyncTicket {
+	tickets := make(map[string]*controller.SyncTicket, len(results))
+	for name, result := range results {
+		tickets[name] = result.Value
+	}
+	return tickets
+}
+
+func (c *Cluster) GetStats(reset bool, name string, statType common.StatType) map[string]Result[*common.StatResponse] {
+	return fanOut(c, func(node bridge.PasarGuardNode) (*common.StatResponse, error) {
+		return node.GetStats(reset, name, statType)
+	})
+}
+
+func (c *Cluster) GetSystemStats() map[string]Result[*common.SystemStatsResponse] {
+	return fanOut(c, func(node bridge.PasarGuardNode) (*common.SystemStatsResponse, error) {
+		return node.GetSystemStats()
+	})
+}
+
+func (c *Cluster) Health() map[string]controller.Health {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	health := make(map[string]controller.Health, len(c.nodes))
+	for name, node := range c.nodes {
+		health[name] = node.Health()
+	}
+	return health
+}
+
+func (c *Cluster) Summary() HealthSummary {
+	var summary HealthSummary
+	for name, health := range c.Health() {
+		switch health {
+		case controller.Healthy:
+			summary.Healthy = append(summary.Healthy, name)
+		case controller.Broken:
+			summary.Broken = append(summary.Broken, name)
+		default:
+			summary.NotConnected = append(summary.NotConnected, name)
+		}
+	}
+	sort.Strings(summary.Healthy)
+	sort.Strings(summary.Broken)
+	sort.Strings(summary.NotConnected)
+	return summary
+}
+
+// fanOut runs call on every node of a snapshot of the cluster, at most
+// c.concurrency at a time, and collects the results by node name.
+func fanOut[T any](c *Cluster, call func(bridge.PasarGuardNode) (T, error)) map[string]Result[T] {
+	c.mu.RLock()
+	nodes := make(map[string]bridge.PasarGuardNode, len(c.nodes))
+	for name, node := range c.nodes {
+		nodes[name] = node
+	}
+	c.mu.RUnlock()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		sem     = make(chan struct{}, c.concurrency)
+		results = make(map[string]Result[T], len(nodes))
+	)
+
+	for name, node := range nodes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			value, err := call(node)
+
+			mu.Lock()
+			results[name] = Result[T]{Value: value, Err: err}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,119 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	bridge "github.com/pasarguard/node_bridge"
+	"github.com/pasarguard/node_bridge/common"
+	"github.com/pasarguard/node_bridge/controller"
+	"github.com/pasarguard/node_bridge/nodetest"
+)
+
+func addTestNode(t *testing.T, c *Cluster, name string, protocol bridge.NodeProtocol) *nodetest.Server {
+	t.Helper()
+
+	apiKey := uuid.New()
+	server, err := nodetest.New(apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	var port int
+	if protocol == bridge.GRPC {
+		port, err = server.ServeGRPC()
+	} else {
+		port, err = server.ServeREST()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.AddNode(name, "127.0.0.1", protocol,
+		bridge.WithPort(port),
+		bridge.WithAPIKey(apiKey),
+		bridge.WithServerCA(server.CertPEM),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestCluster(t *testing.T) {
+	c := New(2)
+	servers := map[string]*nodetest.Server{
+		"grpc-1": addTestNode(t, c, "grpc-1", bridge.GRPC),
+		"grpc-2": addTestNode(t, c, "grpc-2", bridge.GRPC),
+		"rest-1": addTestNode(t, c, "rest-1", bridge.REST),
+	}
+
+	if _, err := c.AddNode("grpc-1", "127.0.0.1", bridge.GRPC, bridge.WithPort(1)); !errors.Is(err, ErrNodeExists) {
+		t.Fatalf("expected ErrNodeExists, got %v", err)
+	}
+
+	for _, name := range []string{"grpc-1", "rest-1"} {
+		node, _ := c.Node(name)
+		if err := node.Start("{}", common.BackendType_XRAY, nil, 60); err != nil {
+			t.Fatal(err)
+		}
+		defer node.Stop()
+	}
+
+	summary := c.Summary()
+	if summary.Total() != 3 || len(summary.Healthy) != 2 || len(summary.NotConnected) != 1 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+
+	users := []*common.User{common.CreateUser("fan@out", nil, []string{"in"})}
+	tickets := c.UpdateUsers(users)
+	if len(tickets) != 3 {
+		t.Fatalf("expected 3 tickets, got %d", len(tickets))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, name := range []string{"grpc-1", "rest-1"} {
+		if err := tickets[name].Wait(ctx); err != nil {
+			t.Fatalf("users did not reach %s: %v", name, err)
+		}
+		if len(servers[name].Users()) != 1 {
+			t.Fatalf("expected 1 user on %s, got %d", name, len(servers[name].Users()))
+		}
+	}
+	if err := tickets["grpc-2"].Wait(ctx); !errors.Is(err, controller.ErrSyncNotRunning) {
+		t.Fatalf("expected ErrSyncNotRunning for grpc-2, got %v", err)
+	}
+
+	servers["rest-1"].SetFailure(nodetest.MethodGetSystemStats, errors.New("boom"))
+	results := c.GetSystemStats()
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	if results["grpc-1"].Err != nil || results["grpc-1"].Value == nil {
+		t.Fatalf("expected grpc-1 to succeed, got %v", results["grpc-1"].Err)
+	}
+	if results["rest-1"].Err == nil {
+		t.Fatal("expected rest-1 to fail")
+	}
+	if results["grpc-2"].Err == nil {
+		t.Fatal("expected stopped grpc-2 to fail")
+	}
+
+	servers["grpc-1"].AddUserTraffic("fan@out", 1, 2)
+	stats := c.GetStats(false, "", common.StatType_UsersStat)
+	if got := len(stats["grpc-1"].Value.GetStats()); got != 2 {
+		t.Fatalf("expected 2 stats from grpc-1, got %d", got)
+	}
+
+	if _, ok := c.Remove("grpc-2"); !ok {
+		t.Fatal("expected grpc-2 to be removed")
+	}
+	if names := c.Names(); len(names) != 2 || names[0] != "grpc-1" || names[1] != "rest-1" {
+		t.Fatalf("unexpected names %v", names)
+	}
+}
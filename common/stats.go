@@ -0,0 +1,199 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	statUser     = "user"
+	statInbound  = "inbound"
+	statOutbound = "outbound"
+)
+
+// The links of a traffic counter
+const (
+	TrafficUplink   = "uplink"
+	TrafficDownlink = "downlink"
+)
+
+// TrafficCounter is a single uplink or downlink counter of a user, inbound or
+// outbound
+type TrafficCounter struct {
+	Name  string
+	Link  string
+	Value int64
+}
+
+// UserTraffic is the traffic of a user, from the
+// user>>>email>>>traffic>>>uplink and downlink counters
+type UserTraffic struct {
+	Email    string
+	Uplink   int64
+	Downlink int64
+}
+
+// InboundTraffic is the traffic of an inbound, from the
+// inbound>>>tag>>>traffic>>>uplink and downlink counters
+type InboundTraffic struct {
+	Tag      string
+	Uplink   int64
+	Downlink int64
+}
+
+// OutboundTraffic is the traffic of an outbound, from the
+// outbound>>>tag>>>traffic>>>uplink and downlink counters
+type OutboundTraffic struct {
+	Tag      string
+	Uplink   int64
+	Downlink int64
+}
+
+// TrafficStats is a decoded StatResponse, only the slice matching the
+// requested StatType is filled
+type TrafficStats struct {
+	Users     []UserTraffic
+	Inbounds  []InboundTraffic
+	Outbounds []OutboundTraffic
+}
+
+// StatError reports a Stat that is not a traffic counter of the requested type
+type StatError struct {
+	Stat   *Stat
+	Reason string
+}
+
+func (e *StatError) Error() string {
+	return fmt.Sprintf("malformed stat %s>>>%s>>>%s: %s", e.Stat.GetType(), e.Stat.GetName(), e.Stat.GetLink(), e.Reason)
+}
+
+// DecodeTrafficStats decodes the response of a GetStats call of statType.
+// The uplink and downlink counters of a name are merged into one entry, in
+// the order the names first appear. Malformed stats are skipped and reported
+// as *StatError, joined in the returned error along with the valid entries.
+func DecodeTrafficStats(resp *StatResponse, statType StatType) (TrafficStats, error) {
+	kind, ok := statKind(statType)
+	if !ok {
+		return TrafficStats{}, unknownStatType(statType)
+	}
+
+	var (
+		names   []string
+		traffic = make(map[string]*links)
+		seen    = make(map[[2]string]bool)
+		errs    []error
+	)
+	for _, stat := range resp.GetStats() {
+		c, err := decodeTrafficCounter(stat, kind)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		key := [2]string{c.Name, c.Link}
+		if seen[key] {
+			errs = append(errs, &StatError{Stat: stat, Reason: "duplicate counter"})
+			continue
+		}
+		seen[key] = true
+
+		t, ok := traffic[c.Name]
+		if !ok {
+			t = new(links)
+			traffic[c.Name] = t
+			names = append(names, c.Name)
+		}
+		if c.Link == TrafficUplink {
+			t.uplink = c.Value
+		} else {
+			t.downlink = c.Value
+		}
+	}
+
+	var stats TrafficStats
+	for _, name := range names {
+		t := traffic[name]
+		switch kind {
+		case statUser:
+			stats.Users = append(stats.Users, UserTraffic{Email: name, Uplink: t.uplink, Downlink: t.downlink})
+		case statInbound:
+			stats.Inbounds = append(stats.Inbounds, InboundTraffic{Tag: name, Uplink: t.uplink, Downlink: t.downlink})
+		case statOutbound:
+			stats.Outbounds = append(stats.Outbounds, OutboundTraffic{Tag: name, Uplink: t.uplink, Downlink: t.downlink})
+		}
+	}
+	return stats, errors.Join(errs...)
+}
+
+// DecodeTrafficCounter decodes a single stat of a GetStats call of statType,
+// for consumers that need to know which counters were actually returned
+func DecodeTrafficCounter(stat *Stat, statType StatType) (TrafficCounter, error) {
+	kind, ok := statKind(statType)
+	if !ok {
+		return TrafficCounter{}, unknownStatType(statType)
+	}
+	return decodeTrafficCounter(stat, kind)
+}
+
+// DecodeUserTraffic decodes the response of a UsersStat or UserStat call
+func DecodeUserTraffic(resp *StatResponse) ([]UserTraffic, error) {
+	stats, err := DecodeTrafficStats(resp, StatType_UsersStat)
+	return stats.Users, err
+}
+
+// DecodeInboundTraffic decodes the response of an Inbounds or Inbound call
+func DecodeInboundTraffic(resp *StatResponse) ([]InboundTraffic, error) {
+	stats, err := DecodeTrafficStats(resp, StatType_Inbounds)
+	return stats.Inbounds, err
+}
+
+// DecodeOutboundTraffic decodes the response of an Outbounds or Outbound call
+func DecodeOutboundTraffic(resp *StatResponse) ([]OutboundTraffic, error) {
+	stats, err := DecodeTrafficStats(resp, StatType_Outbounds)
+	return stats.Outbounds, err
+}
+
+// links holds the uplink and downlink counters of a name
+type links struct {
+	uplink   int64
+	downlink int64
+}
+
+func statKind(statType StatType) (string, bool) {
+	switch statType {
+	case StatType_UsersStat, StatType_UserStat:
+		return statUser, true
+	case StatType_Inbounds, StatType_Inbound:
+		return statInbound, true
+	case StatType_Outbounds, StatType_Outbound:
+		return statOutbound, true
+	default:
+		return "", false
+	}
+}
+
+func unknownStatType(statType StatType) error {
+	return fmt.Errorf("unknown stat type %d", statType)
+}
+
+func decodeTrafficCounter(stat *Stat, kind string) (TrafficCounter, error) {
+	if err := validateStat(stat, kind); err != nil {
+		return TrafficCounter{}, err
+	}
+	return TrafficCounter{Name: stat.GetName(), Link: stat.GetLink(), Value: stat.GetValue()}, nil
+}
+
+func validateStat(stat *Stat, kind string) error {
+	switch {
+	case stat == nil:
+		return &StatError{Stat: stat, Reason: "missing stat"}
+	case stat.GetType() != kind:
+		return &StatError{Stat: stat, Reason: fmt.Sprintf("expected type %q", kind)}
+	case stat.GetName() == "":
+		return &StatError{Stat: stat, Reason: "empty name"}
+	case stat.GetLink() != TrafficUplink && stat.GetLink() != TrafficDownlink:
+		return &StatError{Stat: stat, Reason: "link is neither uplink nor downlink"}
+	case stat.GetValue() < 0:
+		return &StatError{Stat: stat, Reason: "negative value"}
+	}
+	return nil
+}
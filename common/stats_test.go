@@ -0,0 +1,71 @@
+package common
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestDecodeTrafficStats(t *testing.T) {
+	resp := &StatResponse{Stats: []*Stat{
+		{Name: "bob", Type: "user", Link: "uplink", Value: 1},
+		{Name: "alice", Type: "user", Link: "downlink", Value: 20},
+		{Name: "bob", Type: "user", Link: "downlink", Value: 2},
+		{Name: "alice", Type: "user", Link: "uplink", Value: 10},
+		{Name: "carol", Type: "user", Link: "downlink", Value: 30},
+		{Name: "direct", Type: "outbound", Link: "uplink", Value: 5},
+		{Name: "", Type: "user", Link: "uplink", Value: 5},
+		{Name: "bob", Type: "user", Link: "sideways", Value: 5},
+		{Name: "bob", Type: "user", Link: "uplink", Value: 5},
+		{Name: "dave", Type: "user", Link: "uplink", Value: -1},
+	}}
+
+	users, err := DecodeUserTraffic(resp)
+	expected := []UserTraffic{
+		{Email: "bob", Uplink: 1, Downlink: 2},
+		{Email: "alice", Uplink: 10, Downlink: 20},
+		{Email: "carol", Downlink: 30},
+	}
+	if !slices.Equal(users, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, users)
+	}
+
+	var errs interface{ Unwrap() []error }
+	if !errors.As(err, &errs) || len(errs.Unwrap()) != 5 {
+		t.Fatalf("expected 5 errors, got %v", err)
+	}
+	for _, err := range errs.Unwrap() {
+		var statErr *StatError
+		if !errors.As(err, &statErr) {
+			t.Fatalf("expected a StatError, got %v", err)
+		}
+	}
+
+	outbounds, err := DecodeOutboundTraffic(&StatResponse{Stats: resp.Stats[5:6]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(outbounds, []OutboundTraffic{{Tag: "direct", Uplink: 5}}) {
+		t.Fatalf("unexpected outbounds %+v", outbounds)
+	}
+
+	stats, err := DecodeTrafficStats(&StatResponse{}, StatType_Inbound)
+	if err != nil || len(stats.Inbounds) != 0 {
+		t.Fatalf("expected no inbounds, got %+v %v", stats, err)
+	}
+	if _, err := DecodeTrafficStats(&StatResponse{}, StatType(42)); err == nil {
+		t.Fatal("expected an error for an unknown stat type")
+	}
+}
+
+func TestDecodeTrafficCounter(t *testing.T) {
+	c, err := DecodeTrafficCounter(&Stat{Name: "vless-in", Type: "inbound", Link: "uplink", Value: 3}, StatType_Inbound)
+	if err != nil || c != (TrafficCounter{Name: "vless-in", Link: TrafficUplink, Value: 3}) {
+		t.Fatalf("unexpected counter %+v %v", c, err)
+	}
+
+	var statErr *StatError
+	if _, err := DecodeTrafficCounter(&Stat{Name: "vless-in", Type: "inbound", Link: "uplink"}, StatType_UsersStat); !errors.As(err, &statErr) {
+		t.Fatalf("expected a StatError, got %v", err)
+	}
+}
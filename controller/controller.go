@@ -2,11 +2,14 @@ package controller
 
 import (
 	"context"
+	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 
 	"github.com/pasarguard/node_bridge/common"
+	"github.com/pasarguard/node_bridge/tracing"
 )
 
 type Health int
@@ -17,30 +20,91 @@ const (
 	Healthy
 )
 
+func (h Health) String() string {
+	switch h {
+	case NotConnected:
+		return "NotConnected"
+	case Broken:
+		return "Broken"
+	case Healthy:
+		return "Healthy"
+	default:
+		return "Unknown"
+	}
+}
+
+// LogEntry is a line of the node's log stream or the error that ended it.
+// Parsed is set for Xray log lines when WithParsedLogs is used. An entry
+// with Gap set marks a reconnect, see WithLogReconnect, and one with Dropped
+// set the number of entries lost since the previous such entry.
 type LogEntry struct {
-	Line string
-	Err  error
+	Line    string
+	Err     error
+	Parsed  *XrayLog
+	Gap     time.Duration
+	Dropped uint64
 }
 
 type Controller struct {
-	health        Health
-	nodeVersion   string
-	coreVersion   string
-	apiKey        string
-	extra         map[string]interface{}
-	logChanSize   int
-	mu            sync.RWMutex
-	SyncManager   *SyncManager
-	HardResetChan chan struct{}
-}
-
-func New(apiKey uuid.UUID, logChanSize int, extra map[string]interface{}) Controller {
+	health Health
+	// previousHealth is the health before the last change
+	previousHealth Health
+	nodeVersion    string
+	coreVersion    string
+	apiKey         string
+	extra          map[string]interface{}
+	logChanSize    int
+	mu             sync.RWMutex
+	SyncManager    *SyncManager
+	HardResetChan  chan struct{}
+
+	options         options
+	healthSubs      *healthSubscribers
+	supervisor      supervisorState
+	users           map[string]*common.User
+	reconcile       ReconcileFunc
+	syncStats       *syncCounters
+	probeFailures   int
+	probeSuccesses  int
+	lastProbeErr    error
+	lastProbeOkTime time.Time
+	logs            *logHub
+}
+
+// options holds the optional behaviour configured through Option
+type options struct {
+	healthCheck     *HealthCheck
+	supervisor      *Supervisor
+	timeouts        *Timeouts
+	defaultTimeouts *Timeouts
+	syncPolicy      *SyncPolicy
+	reconcile       *time.Duration
+	pendingStore    PendingStore
+	metrics         *metricsState
+	tracer          tracing.Tracer
+	logger          *slog.Logger
+	parseLogs       bool
+}
+
+// Option configures optional Controller behaviour
+type Option func(*options)
+
+func New(apiKey uuid.UUID, logChanSize int, extra map[string]interface{}, opts ...Option) Controller {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	return Controller{
 		health:        NotConnected,
 		apiKey:        apiKey.String(),
 		extra:         extra,
 		logChanSize:   logChanSize,
 		HardResetChan: make(chan struct{}, 1),
+		options:       o,
+		healthSubs:    &healthSubscribers{subs: make(map[chan HealthEvent]struct{})},
+		syncStats:     &syncCounters{},
+		logs:          &logHub{},
 	}
 }
 
@@ -64,8 +128,9 @@ func (c *Controller) Extra() map[string]interface{} {
 
 func (c *Controller) SetHealth(health Health) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.health = health
+	ev := c.setHealthLocked(health, ReasonManual, nil)
+	c.mu.Unlock()
+	c.emit(ev)
 }
 
 func (c *Controller) Health() Health {
@@ -74,12 +139,49 @@ func (c *Controller) Health() Health {
 	return c.health
 }
 
-func (c *Controller) UpdateUsers(users []*common.User) {
+// UpdateUsers queues users for the node. The returned ticket fails with
+// ErrSyncNotRunning if the node isn't started.
+func (c *Controller) UpdateUsers(users []*common.User) *SyncTicket {
+	c.mu.RLock()
+	sm := c.SyncManager
+	c.mu.RUnlock()
+	c.trackUsers(users)
+	if sm == nil {
+		return failedSyncTicket(ErrSyncNotRunning)
+	}
+	return sm.UpdateUsers(users)
+}
+
+// RemoveUsers removes users from the node through the sync pipeline
+func (c *Controller) RemoveUsers(emails ...string) *SyncTicket {
+	c.mu.RLock()
+	sm := c.SyncManager
+	c.mu.RUnlock()
+	c.untrackUsers(emails)
+	if sm == nil {
+		return failedSyncTicket(ErrSyncNotRunning)
+	}
+	return sm.RemoveUsers(emails...)
+}
+
+// PendingUsers lists the users that have not reached the node yet
+func (c *Controller) PendingUsers() []PendingUser {
+	c.mu.RLock()
+	sm := c.SyncManager
+	c.mu.RUnlock()
+	if sm == nil {
+		return nil
+	}
+	return sm.PendingUsers()
+}
+
+// FlushUsers syncs pending user updates right away
+func (c *Controller) FlushUsers() {
 	c.mu.RLock()
 	sm := c.SyncManager
 	c.mu.RUnlock()
 	if sm != nil {
-		sm.UpdateUsers(users)
+		sm.Flush()
 	}
 }
 
@@ -88,16 +190,40 @@ func (c *Controller) HardReset() <-chan struct{} {
 }
 
 func (c *Controller) triggerHardReset() {
+	c.options.metrics.hardReset()
+	c.mu.Lock()
 	select {
 	case c.HardResetChan <- struct{}{}:
 	default:
 	}
+	var ev *HealthEvent
+	if c.health == Healthy {
+		ev = c.setHealthLocked(Broken, ReasonHardReset, nil)
+	}
+	c.mu.Unlock()
+	c.emit(ev)
 }
 
 func (c *Controller) StartSync(ctx context.Context, syncer func([]*common.User) error) {
+	sm := NewSyncManagerWithPolicy(ctx, syncer, c.triggerHardReset, c.SyncPolicy())
+	sm.stats = c.syncStats
+	sm.metrics = c.options.metrics
+	sm.logger = c.Logger()
+	if store := c.options.pendingStore; store != nil {
+		sm.store = store
+		sm.storeFailed = func(err error) { c.ReportError(ReasonPendingStoreFailed, err) }
+		// Replayed before anyone can queue a newer version of these users
+		sm.replay()
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.SyncManager = NewSyncManager(ctx, syncer, c.triggerHardReset)
+	c.SyncManager = sm
+}
+
+// SyncStats returns the user update counters, kept across restarts
+func (c *Controller) SyncStats() SyncStats {
+	return c.syncStats.snapshot()
 }
 
 func (c *Controller) NodeVersion() string {
@@ -114,23 +240,28 @@ func (c *Controller) CoreVersion() string {
 
 func (c *Controller) Connect(nodeVersion, coreVersion string) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
 	c.nodeVersion = nodeVersion
 	c.coreVersion = coreVersion
-	c.health = Healthy
+	ev := c.setHealthLocked(Healthy, ReasonConnected, nil)
+	c.resetProbeState()
+	c.mu.Unlock()
+
+	c.emit(ev)
 }
 
 func (c *Controller) Disconnect() {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
 	close(c.HardResetChan)
 
 	c.HardResetChan = make(chan struct{}, 1)
 	c.SyncManager = nil
+	c.reconcile = nil
 
 	c.nodeVersion = ""
 	c.coreVersion = ""
-	c.health = NotConnected
+	ev := c.setHealthLocked(NotConnected, ReasonDisconnected, nil)
+	c.resetProbeState()
+	c.mu.Unlock()
+
+	c.emit(ev)
 }
@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/pasarguard/node_bridge/common"
+)
+
+func TestController_HealthEvents(t *testing.T) {
+	c := New(uuid.New(), 10, nil)
+
+	events, unsubscribe := c.SubscribeHealth(10)
+	defer unsubscribe()
+
+	c.Connect("node", "core")
+	c.triggerHardReset()
+	c.ReportError(ReasonStopFailed, errors.New("boom"))
+	c.Disconnect()
+
+	expected := []HealthEvent{
+		{Previous: NotConnected, Current: Healthy, Reason: ReasonConnected},
+		{Previous: Healthy, Current: Broken, Reason: ReasonHardReset},
+		{Previous: Broken, Current: Broken, Reason: ReasonStopFailed},
+		{Previous: Broken, Current: NotConnected, Reason: ReasonDisconnected},
+	}
+	for i, want := range expected {
+		got := <-events
+		if got.Previous != want.Previous || got.Current != want.Current || got.Reason != want.Reason {
+			t.Fatalf("event %d: expected %v -> %v (%s), got %v -> %v (%s)",
+				i, want.Previous, want.Current, want.Reason, got.Previous, got.Current, got.Reason)
+		}
+		if got.Time.IsZero() {
+			t.Fatalf("event %d: expected timestamp", i)
+		}
+	}
+
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Fatal("expected channel to be closed after unsubscribe")
+	}
+}
+
+func TestController_Reconcile(t *testing.T) {
+	disabled := New(uuid.New(), 10, nil)
+	if err := disabled.Reconcile(context.Background()); !errors.Is(err, ErrReconcileDisabled) {
+		t.Fatalf("expected ErrReconcileDisabled, got %v", err)
+	}
+
+	c := New(uuid.New(), 10, nil, WithReconcile(20*time.Millisecond))
+	if err := c.Reconcile(context.Background()); !errors.Is(err, ErrSyncNotRunning) {
+		t.Fatalf("expected ErrSyncNotRunning, got %v", err)
+	}
+
+	pushes := make(chan []*common.User, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c.StartReconcile(ctx, func(_ context.Context, users []*common.User) error {
+		select {
+		case pushes <- users:
+		case <-ctx.Done():
+		}
+		return nil
+	})
+	c.Supervise("{}", common.BackendType_XRAY, []*common.User{
+		{Email: "user1@example.com", Inbounds: []string{"in"}},
+		{Email: "user2@example.com", Inbounds: []string{"in"}},
+	}, 0, nil)
+	c.UpdateUsers([]*common.User{{Email: "user3@example.com", Inbounds: []string{"in"}}})
+	c.RemoveUsers("user1@example.com")
+
+	if users := c.Users(); len(users) != 2 {
+		t.Fatalf("expected 2 tracked users, got %d", len(users))
+	}
+
+	for i := range 2 {
+		select {
+		case users := <-pushes:
+			if len(users) != 2 {
+				t.Fatalf("expected the full user set of 2 to be pushed, got %d", len(users))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected periodic pushes, got %d", i)
+		}
+	}
+}
+
+func TestController_Logger(t *testing.T) {
+	var mu sync.Mutex
+	var buf strings.Builder
+	logger := slog.New(slog.NewTextHandler(&lockedWriter{mu: &mu, w: &buf}, nil))
+
+	c := New(uuid.New(), 10, nil, WithLogger(logger), WithSyncPolicy(SyncPolicy{MaxRetries: 2, InitialBackoff: 10 * time.Millisecond, MaxBackoff: time.Hour}))
+	c.Connect("node", "core")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.StartSync(ctx, func([]*common.User) error { return errors.New("node unavailable") })
+	c.UpdateUsers([]*common.User{{Email: "user1@example.com"}})
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), time.Second)
+	defer waitCancel()
+	for c.Health() != Broken && waitCtx.Err() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	mu.Lock()
+	out := buf.String()
+	mu.Unlock()
+	for _, want := range []string{
+		`level=INFO msg="node health event" previous=NotConnected current=Healthy reason=connected`,
+		`level=WARN msg="user sync failed, retrying" users=1 failures=1`,
+		`level=ERROR msg="user sync keeps failing, triggering hard reset" users=1 failures=2`,
+		`level=WARN msg="node health event" previous=Healthy current=Broken reason="hard reset"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in log output:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `msg="user sync failed, retrying" users=1 failures=2`) {
+		t.Errorf("expected the hard reset to be logged instead of a retry:\n%s", out)
+	}
+}
+
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+func TestController_Timeouts(t *testing.T) {
+	c := New(uuid.New(), 10, nil)
+	if c.Timeouts() != DefaultTimeouts() {
+		t.Fatalf("expected the default timeouts, got %+v", c.Timeouts())
+	}
+
+	// Zero fields fall back to the defaults of the transport, whatever the
+	// order of the options
+	c = New(uuid.New(), 10, nil, WithTimeouts(Timeouts{Unary: time.Second}), WithDefaultTimeouts(DefaultRESTTimeouts()))
+	expected := DefaultRESTTimeouts()
+	expected.Unary = time.Second
+	if c.Timeouts() != expected {
+		t.Fatalf("expected %+v, got %+v", expected, c.Timeouts())
+	}
+}
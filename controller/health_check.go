@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/pasarguard/node_bridge/common"
+)
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultFailureThreshold    = 3
+	DefaultSuccessThreshold    = 1
+)
+
+var ErrBackendNotStarted = errors.New("node reports backend not started")
+
+// HealthCheck configures the background prober started by StartHealthCheck.
+// A zero Interval is derived from the keepAlive passed to Start.
+type HealthCheck struct {
+	Interval         time.Duration
+	FailureThreshold int
+	SuccessThreshold int
+}
+
+// WithHealthCheck enables active health checking
+func WithHealthCheck(hc HealthCheck) Option {
+	return func(o *options) {
+		if hc.FailureThreshold <= 0 {
+			hc.FailureThreshold = DefaultFailureThreshold
+		}
+		if hc.SuccessThreshold <= 0 {
+			hc.SuccessThreshold = DefaultSuccessThreshold
+		}
+		o.healthCheck = &hc
+	}
+}
+
+// StartHealthCheck calls info on an interval until ctx is done, moving the node
+// between Healthy and Broken after consecutive failures or successes. A node
+// that answers but no longer runs its backend counts as a failure.
+// It is a no-op when health checking is not enabled.
+func (c *Controller) StartHealthCheck(ctx context.Context, keepAlive uint64, info func(context.Context) (*common.BaseInfoResponse, error)) {
+	hc := c.options.healthCheck
+	if hc == nil {
+		return
+	}
+
+	interval := hc.Interval
+	if interval <= 0 {
+		// Probe well within keepAlive so the node never considers us gone
+		interval = time.Duration(keepAlive) * time.Second / 3
+		if interval <= 0 {
+			interval = DefaultHealthCheckInterval
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				resp, err := info(ctx)
+				if err == nil && !resp.GetStarted() {
+					err = ErrBackendNotStarted
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				c.recordProbe(err, hc)
+			}
+		}
+	}()
+}
+
+func (c *Controller) recordProbe(err error, hc *HealthCheck) {
+	var ev *HealthEvent
+	c.mu.Lock()
+	c.lastProbeErr = err
+	if err != nil {
+		c.probeSuccesses = 0
+		c.probeFailures++
+		if c.health == Healthy && c.probeFailures >= hc.FailureThreshold {
+			ev = c.setHealthLocked(Broken, ReasonHealthCheckFailed, err)
+		}
+	} else {
+		c.lastProbeOkTime = time.Now()
+		c.probeFailures = 0
+		c.probeSuccesses++
+		if c.health == Broken && c.probeSuccesses >= hc.SuccessThreshold {
+			ev = c.setHealthLocked(Healthy, ReasonHealthCheckRecovered, nil)
+		}
+	}
+	failures := c.probeFailures
+	c.mu.Unlock()
+
+	if err != nil {
+		c.Logger().Debug("health check failed", "failures", failures, "error", err)
+	}
+	c.emit(ev)
+}
+
+func (c *Controller) resetProbeState() {
+	c.probeFailures = 0
+	c.probeSuccesses = 0
+	c.lastProbeErr = nil
+}
+
+// LastHealthError returns the error of the most recent probe, nil if it succeeded
+func (c *Controller) LastHealthError() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastProbeErr
+}
+
+// LastHealthCheck returns the time of the last successful probe
+func (c *Controller) LastHealthCheck() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastProbeOkTime
+}
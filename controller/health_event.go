@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"sync"
+	"time"
+)
+
+// Reasons attached to a HealthEvent
+const (
+	ReasonConnected            = "connected"
+	ReasonDisconnected         = "disconnected"
+	ReasonHealthCheckFailed    = "health check failed"
+	ReasonHealthCheckRecovered = "health check recovered"
+	ReasonHardReset            = "hard reset"
+	ReasonStartFailed          = "start failed"
+	ReasonStopFailed           = "stop failed"
+	ReasonManual               = "set manually"
+)
+
+// HealthEvent describes a health transition of a node. Failures that leave
+// the health unchanged, such as a failed Start, are reported with
+// Previous equal to Current and Err set.
+type HealthEvent struct {
+	Previous Health
+	Current  Health
+	Reason   string
+	Err      error
+	Time     time.Time
+}
+
+type healthSubscribers struct {
+	mu   sync.Mutex
+	subs map[chan HealthEvent]struct{}
+}
+
+// SubscribeHealth returns a channel receiving every HealthEvent of the node and
+// a function that cancels the subscription and closes the channel.
+// Events are dropped for subscribers whose buffer is full.
+func (c *Controller) SubscribeHealth(bufferSize int) (<-chan HealthEvent, func()) {
+	if bufferSize <= 0 {
+		bufferSize = 16
+	}
+	ch := make(chan HealthEvent, bufferSize)
+
+	hs := c.healthSubs
+	hs.mu.Lock()
+	hs.subs[ch] = struct{}{}
+	hs.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			hs.mu.Lock()
+			delete(hs.subs, ch)
+			close(ch)
+			hs.mu.Unlock()
+		})
+	}
+}
+
+// ReportError emits an event for a failure that does not change the health of the node
+func (c *Controller) ReportError(reason string, err error) {
+	health := c.Health()
+	c.emit(&HealthEvent{Previous: health, Current: health, Reason: reason, Err: err, Time: time.Now()})
+}
+
+// setHealthLocked must be called with c.mu held. It returns the event to emit
+// once the lock is released, or nil if the health did not change.
+func (c *Controller) setHealthLocked(health Health, reason string, err error) *HealthEvent {
+	if c.health == health {
+		return nil
+	}
+	ev := &HealthEvent{Previous: c.health, Current: health, Reason: reason, Err: err, Time: time.Now()}
+	c.previousHealth, c.health = c.health, health
+	return ev
+}
+
+// healthChange returns the health before and after its last change
+func (c *Controller) healthChange() (Health, Health) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.previousHealth, c.health
+}
+
+func (c *Controller) emit(ev *HealthEvent) {
+	if ev == nil {
+		return
+	}
+	c.logHealthEvent(ev)
+
+	hs := c.healthSubs
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for ch := range hs.subs {
+		select {
+		case ch <- *ev:
+		default:
+		}
+	}
+}
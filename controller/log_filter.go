@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// LogLevel is the severity of an Xray log line. Access log lines are Info.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota + 1
+	LogLevelInfo
+	LogLevelWarning
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "Debug"
+	case LogLevelInfo:
+		return "Info"
+	case LogLevelWarning:
+		return "Warning"
+	case LogLevelError:
+		return "Error"
+	default:
+		return "Unknown"
+	}
+}
+
+// ParseLogLevel parses an Xray level name such as Warning, case insensitive
+func ParseLogLevel(s string) (LogLevel, bool) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LogLevelDebug, true
+	case "info":
+		return LogLevelInfo, true
+	case "warning", "warn":
+		return LogLevelWarning, true
+	case "error":
+		return LogLevelError, true
+	default:
+		return 0, false
+	}
+}
+
+// LogLevel returns the severity of the line, zero when it is unknown
+func (l *XrayLog) LogLevel() LogLevel {
+	if l.Kind == XrayAccessLog {
+		return LogLevelInfo
+	}
+	level, _ := ParseLogLevel(l.Level)
+	return level
+}
+
+// logFilter selects the lines a subscriber receives. Every filter that is set
+// has to match, entries without a line such as errors and gaps always pass.
+type logFilter struct {
+	minLevel LogLevel
+	include  []*regexp.Regexp
+	exclude  []*regexp.Regexp
+	emails   []string
+	inbounds []string
+}
+
+// WithLogMinLevel only keeps Xray lines of at least level. Lines that are
+// not Xray log lines have no level and are dropped too.
+func WithLogMinLevel(level LogLevel) LogStreamOption {
+	return func(o *logStreamOptions) {
+		o.filter.minLevel = level
+	}
+}
+
+// WithLogInclude only keeps lines matching at least one of the expressions
+func WithLogInclude(exprs ...*regexp.Regexp) LogStreamOption {
+	return func(o *logStreamOptions) {
+		o.filter.include = append(o.filter.include, exprs...)
+	}
+}
+
+// WithLogExclude drops lines matching any of the expressions
+func WithLogExclude(exprs ...*regexp.Regexp) LogStreamOption {
+	return func(o *logStreamOptions) {
+		o.filter.exclude = append(o.filter.exclude, exprs...)
+	}
+}
+
+// WithLogEmails only keeps access log lines of the given users
+func WithLogEmails(emails ...string) LogStreamOption {
+	return func(o *logStreamOptions) {
+		o.filter.emails = append(o.filter.emails, emails...)
+	}
+}
+
+// WithLogInboundTags only keeps access log lines of the given inbounds
+func WithLogInboundTags(tags ...string) LogStreamOption {
+	return func(o *logStreamOptions) {
+		o.filter.inbounds = append(o.filter.inbounds, tags...)
+	}
+}
+
+// needsParse reports whether match needs the parsed line
+func (f *logFilter) needsParse() bool {
+	return f.minLevel > 0 || len(f.emails) > 0 || len(f.inbounds) > 0
+}
+
+// match reports whether line passes the filter, parsed is nil for lines that
+// are not Xray log lines
+func (f *logFilter) match(line string, parsed *XrayLog) bool {
+	if f.minLevel > 0 && (parsed == nil || parsed.LogLevel() < f.minLevel) {
+		return false
+	}
+	if len(f.emails) > 0 && (parsed == nil || !slices.Contains(f.emails, parsed.Email)) {
+		return false
+	}
+	if len(f.inbounds) > 0 && (parsed == nil || !slices.Contains(f.inbounds, parsed.InboundTag)) {
+		return false
+	}
+	if len(f.include) > 0 && !slices.ContainsFunc(f.include, func(re *regexp.Regexp) bool { return re.MatchString(line) }) {
+		return false
+	}
+	return !slices.ContainsFunc(f.exclude, func(re *regexp.Regexp) bool { return re.MatchString(line) })
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"context"
+	"regexp"
+	"testing"
+)
+
+func TestLogFilter(t *testing.T) {
+	const (
+		access  = "2024/01/02 15:04:05 1.2.3.4:5678 accepted tcp:example.com:443 [vmess-in -> direct] email: user1"
+		warning = "2024/01/02 15:04:05 [Warning] app/dispatcher: default route"
+		errLine = "2024/01/02 15:04:05 [Error] failed to handler mux client connection"
+		plain   = "node started"
+	)
+	lines := []string{access, warning, errLine, plain}
+
+	tests := []struct {
+		name string
+		opts []LogStreamOption
+		want []string
+	}{
+		{"none", nil, lines},
+		{"min level", []LogStreamOption{WithLogMinLevel(LogLevelWarning)}, []string{warning, errLine}},
+		{"include", []LogStreamOption{WithLogInclude(regexp.MustCompile(`dispatcher`), regexp.MustCompile(`started`))}, []string{warning, plain}},
+		{"exclude", []LogStreamOption{WithLogExclude(regexp.MustCompile(`accepted`))}, []string{warning, errLine, plain}},
+		{"email", []LogStreamOption{WithLogEmails("user1")}, []string{access}},
+		{"other email", []LogStreamOption{WithLogEmails("user2")}, nil},
+		{"inbound", []LogStreamOption{WithLogInboundTags("vless-in", "vmess-in")}, []string{access}},
+		{"combined", []LogStreamOption{WithLogMinLevel(LogLevelInfo), WithLogExclude(regexp.MustCompile(`Error`))}, []string{access, warning}},
+	}
+
+	for _, tt := range tests {
+		var o logStreamOptions
+		for _, opt := range tt.opts {
+			opt(&o)
+		}
+		var got []string
+		for _, line := range lines {
+			parsed, _ := ParseXrayLog(line)
+			if o.filter.match(line, parsed) {
+				got = append(got, line)
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestController_LogFilter(t *testing.T) {
+	c, open, lines := newFakeLogNode()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A single slot is enough when the access lines never reach the channel
+	logs, err := c.OpenLogStream(ctx, open, WithLogBuffer(1), WithLogMinLevel(LogLevelWarning))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const warning = "2024/01/02 15:04:05 [Warning] app/dispatcher: default route"
+	lines <- warning
+	for range 20 {
+		lines <- "2024/01/02 15:04:05 1.2.3.4:5678 accepted tcp:example.com:443 [vmess-in -> direct] email: user1"
+	}
+	if entry := <-logs; entry.Line != warning {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+}
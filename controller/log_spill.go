@@ -0,0 +1,283 @@
+package controller
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+var errLogRecordTooLarge = errors.New("log entry is larger than the spill file")
+
+// logSpill queues the entries of a SpillToDisk subscriber that did not fit
+// its channel. While spilling is set every entry goes through the ring so
+// they reach the channel in order.
+type logSpill struct {
+	ring *logRing
+	wake chan struct{}
+	// spilling is guarded by logSubscriber.mu
+	spilling bool
+}
+
+// spillLogEntry sends entry to the channel of sub, or queues it in the ring
+// when the channel is full or older entries are queued. It returns the
+// number of lines lost. sub.mu must be held.
+func (c *Controller) spillLogEntry(sub *logSubscriber, entry LogEntry) uint64 {
+	sp := sub.spill
+	if !sp.spilling {
+		if c.trySendLogEntry(sub, entry) {
+			return 0
+		}
+		sp.spilling = true
+	}
+
+	var dropped uint64
+	evicted, err := sp.ring.push(encodeLogEntry(entry), entry.Dropped)
+	for _, n := range evicted {
+		dropped += sub.lose(LogEntry{Dropped: n})
+	}
+	if err != nil {
+		if !errors.Is(err, errLogRecordTooLarge) {
+			c.Logger().Warn("failed to spill log entry", "error", err)
+		}
+		dropped += sub.lose(entry)
+	}
+	notify(sp.wake)
+	return dropped
+}
+
+// drainLogSpill moves the queued entries of sub to its channel and closes
+// the channel once sub is closed and nothing is queued anymore, or right
+// away when the consumer left.
+func (c *Controller) drainLogSpill(sub *logSubscriber) {
+	sp := sub.spill
+	defer c.endLogSpill(sub)
+
+	for {
+		data, ok, err := sp.ring.pop()
+		if err != nil {
+			c.Logger().Warn("failed to read spilled log entries", "error", err)
+			lost := sp.ring.reset()
+			sub.mu.Lock()
+			sub.lost += uint64(lost)
+			sub.mu.Unlock()
+			c.recordLogDrops(uint64(lost))
+			continue
+		}
+		if !ok {
+			sub.mu.Lock()
+			if sp.ring.len() > 0 {
+				sub.mu.Unlock()
+				continue
+			}
+			sp.spilling = false
+			closed := sub.closed
+			sub.mu.Unlock()
+			if closed {
+				return
+			}
+
+			select {
+			case <-sp.wake:
+			case <-sub.left:
+				return
+			}
+			continue
+		}
+
+		select {
+		case sub.ch <- decodeLogEntry(data):
+			c.logs.stats.delivered.Add(1)
+		case <-sub.left:
+			return
+		}
+	}
+}
+
+// endLogSpill closes the channel of a spilling sub once its drainer is done.
+// closed is set first so that no push can reach the channel anymore.
+func (c *Controller) endLogSpill(sub *logSubscriber) {
+	sub.mu.Lock()
+	sub.closed = true
+	sub.drained = true
+	stop := sub.stop
+	sub.mu.Unlock()
+
+	sub.spill.ring.close()
+	close(sub.ch)
+	if stop != nil {
+		stop()
+	}
+}
+
+// spilledLogEntry is the encoding of a LogEntry in the ring, Parsed is
+// rebuilt from the line
+type spilledLogEntry struct {
+	Line    string        `json:"line,omitempty"`
+	Err     string        `json:"err,omitempty"`
+	Gap     time.Duration `json:"gap,omitempty"`
+	Dropped uint64        `json:"dropped,omitempty"`
+	Parsed  bool          `json:"parsed,omitempty"`
+}
+
+func encodeLogEntry(entry LogEntry) []byte {
+	spilled := spilledLogEntry{Line: entry.Line, Gap: entry.Gap, Dropped: entry.Dropped, Parsed: entry.Parsed != nil}
+	if entry.Err != nil {
+		spilled.Err = entry.Err.Error()
+	}
+	data, _ := json.Marshal(spilled)
+	return data
+}
+
+func decodeLogEntry(data []byte) LogEntry {
+	var spilled spilledLogEntry
+	if err := json.Unmarshal(data, &spilled); err != nil {
+		return LogEntry{Err: err}
+	}
+	entry := LogEntry{Line: spilled.Line, Gap: spilled.Gap, Dropped: spilled.Dropped}
+	if spilled.Err != "" {
+		entry.Err = errors.New(spilled.Err)
+	}
+	if spilled.Parsed {
+		entry.Parsed, _ = ParseXrayLog(spilled.Line)
+	}
+	return entry
+}
+
+// logRecordHeader is the big-endian uint32 payload length and uint64 Dropped
+// count that precede every record in a logRing
+const logRecordHeader = 12
+
+// logRing is a FIFO of records in a file that never grows beyond size bytes.
+// Records wrap around the end of the file, pushing one that does not fit
+// evicts the oldest ones.
+type logRing struct {
+	mu    sync.Mutex
+	file  *os.File
+	size  int64
+	head  int64
+	used  int64
+	count int
+}
+
+func newLogRing(dir string, size int64) (*logRing, error) {
+	file, err := os.CreateTemp(dir, "node-logs-*.spill")
+	if err != nil {
+		return nil, err
+	}
+	return &logRing{file: file, size: size}, nil
+}
+
+// push appends a record and returns the Dropped count of every record it
+// evicted to make room
+func (r *logRing) push(data []byte, dropped uint64) ([]uint64, error) {
+	need := int64(logRecordHeader + len(data))
+	if need > r.size {
+		return nil, errLogRecordTooLarge
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var evicted []uint64
+	for r.used+need > r.size {
+		n, d, err := r.readHeader(r.head)
+		if err != nil {
+			return evicted, err
+		}
+		r.advance(n)
+		evicted = append(evicted, d)
+	}
+
+	record := make([]byte, need)
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	binary.BigEndian.PutUint64(record[4:], dropped)
+	copy(record[logRecordHeader:], data)
+	if err := r.writeAt(record, (r.head+r.used)%r.size); err != nil {
+		return evicted, err
+	}
+	r.used += need
+	r.count++
+	return evicted, nil
+}
+
+// pop removes the oldest record and returns its payload
+func (r *logRing) pop() ([]byte, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.count == 0 {
+		return nil, false, nil
+	}
+	n, _, err := r.readHeader(r.head)
+	if err != nil {
+		return nil, false, err
+	}
+	data := make([]byte, n)
+	if err := r.readAt(data, (r.head+logRecordHeader)%r.size); err != nil {
+		return nil, false, err
+	}
+	r.advance(n)
+	return data, true, nil
+}
+
+func (r *logRing) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count
+}
+
+// reset forgets every record and returns how many there were
+func (r *logRing) reset() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := r.count
+	r.head, r.used, r.count = 0, 0, 0
+	return count
+}
+
+func (r *logRing) close() {
+	_ = r.file.Close()
+	_ = os.Remove(r.file.Name())
+}
+
+// advance drops the oldest record, whose payload is n bytes long
+func (r *logRing) advance(n int64) {
+	r.head = (r.head + logRecordHeader + n) % r.size
+	r.used -= logRecordHeader + n
+	r.count--
+}
+
+func (r *logRing) readHeader(off int64) (int64, uint64, error) {
+	var header [logRecordHeader]byte
+	if err := r.readAt(header[:], off); err != nil {
+		return 0, 0, err
+	}
+	return int64(binary.BigEndian.Uint32(header[:])), binary.BigEndian.Uint64(header[4:]), nil
+}
+
+func (r *logRing) readAt(p []byte, off int64) error {
+	first := min(int64(len(p)), r.size-off)
+	if _, err := r.file.ReadAt(p[:first], off); err != nil {
+		return err
+	}
+	if first < int64(len(p)) {
+		_, err := r.file.ReadAt(p[first:], 0)
+		return err
+	}
+	return nil
+}
+
+func (r *logRing) writeAt(p []byte, off int64) error {
+	first := min(int64(len(p)), r.size-off)
+	if _, err := r.file.WriteAt(p[:first], off); err != nil {
+		return err
+	}
+	if first < int64(len(p)) {
+		_, err := r.file.WriteAt(p[first:], 0)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultLogReconnectInitialBackoff = 1 * time.Second
+	DefaultLogReconnectMaxBackoff     = 30 * time.Second
+)
+
+// LogSource is an open log stream of the node. Recv blocks until the next
+// line and fails once the context the stream was opened with is done.
+type LogSource interface {
+	Recv() (string, error)
+	Close() error
+}
+
+// LogOpener opens a log stream of the node, it is provided by the transport
+type LogOpener func(ctx context.Context) (LogSource, error)
+
+// LogReconnect configures how StreamLogs reopens a broken stream. The stream
+// is reopened with an exponential backoff from InitialBackoff up to
+// MaxBackoff, randomized by Jitter (0 to 1), once the node is Healthy.
+type LogReconnect struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Jitter         float64
+}
+
+// LogStreamOption configures a single StreamLogs call
+type LogStreamOption func(*logStreamOptions)
+
+type logStreamOptions struct {
+	buffer       int
+	dropPolicy   DropPolicy
+	blockTimeout time.Duration
+	spillDir     string
+	spillSize    int64
+	reconnect    *LogReconnect
+	filter       logFilter
+}
+
+// WithLogReconnect keeps the channel of StreamLogs open when the stream
+// breaks and reopens the stream instead. Each reopen is announced by an entry
+// with Gap set to how long the stream was down. The channel is closed once
+// the caller's context is done or the node is stopped.
+func WithLogReconnect(r LogReconnect) LogStreamOption {
+	return func(o *logStreamOptions) {
+		if r.InitialBackoff <= 0 {
+			r.InitialBackoff = DefaultLogReconnectInitialBackoff
+		}
+		if r.MaxBackoff < r.InitialBackoff {
+			r.MaxBackoff = max(DefaultLogReconnectMaxBackoff, r.InitialBackoff)
+		}
+		r.Jitter = min(max(r.Jitter, 0), 1)
+		o.reconnect = &r
+	}
+}
+
+// WithLogBuffer sets the channel size of a subscription, the log channel
+// size of the node by default
+func WithLogBuffer(size int) LogStreamOption {
+	return func(o *logStreamOptions) {
+		o.buffer = max(size, 0)
+	}
+}
+
+// logHub shares one upstream log stream of the node between every
+// subscriber. The upstream runs while there is at least one subscriber.
+type logHub struct {
+	mu       sync.Mutex
+	subs     []*logSubscriber
+	upstream *logUpstream
+	stats    logCounters
+}
+
+type logUpstream struct {
+	cancel context.CancelFunc
+}
+
+// OpenLogStream subscribes to the node's log. The first subscriber opens the
+// upstream stream through open and the last one to leave closes it. Without
+// WithLogReconnect the channel is closed after an entry with Err set once the
+// stream breaks. Every channel is closed by StopLogStreams.
+func (c *Controller) OpenLogStream(ctx context.Context, open LogOpener, opts ...LogStreamOption) (<-chan LogEntry, error) {
+	if c.Health() == NotConnected {
+		return nil, errors.New("node not connected")
+	}
+
+	o := logStreamOptions{buffer: c.LogChanSize()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	sub, err := c.newLogSubscriber(o)
+	if err != nil {
+		return nil, err
+	}
+
+	h := c.logs
+	h.mu.Lock()
+	h.subs = append(h.subs, sub)
+	if h.upstream == nil {
+		upstreamCtx, cancel := context.WithCancel(context.Background())
+		h.upstream = &logUpstream{cancel: cancel}
+		go c.runLogUpstream(upstreamCtx, h.upstream, open)
+	}
+	h.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() { c.unsubscribeLogs(sub) })
+	sub.mu.Lock()
+	if sub.closed && (sub.spill == nil || sub.drained) {
+		stop()
+	} else {
+		sub.stop = stop
+	}
+	sub.mu.Unlock()
+
+	return sub.ch, nil
+}
+
+// StopLogStreams closes every channel returned by OpenLogStream
+func (c *Controller) StopLogStreams() {
+	h := c.logs
+	h.mu.Lock()
+	if h.upstream != nil {
+		h.upstream.cancel()
+		h.upstream = nil
+	}
+	subs := h.subs
+	h.subs = nil
+	h.mu.Unlock()
+
+	for _, sub := range subs {
+		if sub.opts.dropPolicy == BlockWithTimeout {
+			// Wakes up a push blocked on sub, nothing more reaches it anyway
+			sub.leave()
+		}
+		sub.close()
+	}
+}
+
+func (c *Controller) unsubscribeLogs(sub *logSubscriber) {
+	// Wakes up a push blocked on sub before taking the lock it may hold
+	sub.leave()
+
+	h := c.logs
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := slices.Index(h.subs, sub)
+	if i < 0 {
+		return
+	}
+	h.subs = slices.Delete(h.subs, i, i+1)
+	sub.close()
+	if len(h.subs) == 0 && h.upstream != nil {
+		h.upstream.cancel()
+		h.upstream = nil
+	}
+}
+
+// runLogUpstream reads the node's log and broadcasts it until ctx is done or
+// no subscriber is left to reconnect for
+func (c *Controller) runLogUpstream(ctx context.Context, u *logUpstream, open LogOpener) {
+	var backoff time.Duration
+	// When the stream broke, zero while it is up
+	var down time.Time
+
+	for {
+		var brokeAt time.Time
+		source, err := c.openLogSource(ctx, open)
+		if err == nil {
+			if !down.IsZero() {
+				c.Logger().Info("log stream reconnected", "gap", time.Since(down))
+				down = time.Time{}
+				backoff = 0
+			}
+			c.announceLogGaps(u)
+			err = c.readLogSource(source, func(line string) { c.broadcastLog(u, line) })
+			_ = source.Close()
+			if ctx.Err() != nil {
+				return
+			}
+			c.Logger().Warn("log stream broke", "error", err)
+			brokeAt = time.Now()
+			down = brokeAt
+		} else {
+			if ctx.Err() != nil {
+				return
+			}
+			c.Logger().Warn("failed to open log stream", "error", err)
+		}
+
+		reconnect := c.failLogSubscribers(u, err, brokeAt)
+		if reconnect == nil {
+			return
+		}
+		if backoff == 0 {
+			backoff = reconnect.InitialBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(withJitter(backoff, reconnect.Jitter)):
+		}
+		backoff = nextBackoff(backoff, DefaultBackoffFactor, reconnect.MaxBackoff)
+		if !c.waitHealthy(ctx) {
+			return
+		}
+	}
+}
+
+// subscribers returns the subscribers fed by u, none once u was replaced
+func (c *Controller) subscribers(u *logUpstream) []*logSubscriber {
+	h := c.logs
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.upstream != u {
+		return nil
+	}
+	return slices.Clone(h.subs)
+}
+
+// broadcastLog hands line to the subscribers whose filter it passes. It is
+// parsed at most once, whether for WithParsedLogs or for the filters.
+func (c *Controller) broadcastLog(u *logUpstream, line string) {
+	c.logs.stats.received.Add(1)
+	entry := c.logLine(line)
+	parsed, parseTried := entry.Parsed, c.options.parseLogs
+	for _, sub := range c.subscribers(u) {
+		if sub.opts.filter.needsParse() && !parseTried {
+			parsed, _ = ParseXrayLog(line)
+			parseTried = true
+		}
+		if sub.opts.filter.match(line, parsed) {
+			c.pushLogEntry(sub, entry)
+		}
+	}
+}
+
+// announceLogGaps tells the subscribers that were there when the stream
+// broke how long it was down
+func (c *Controller) announceLogGaps(u *logUpstream) {
+	type logGap struct {
+		sub *logSubscriber
+		gap time.Duration
+	}
+
+	h := c.logs
+	h.mu.Lock()
+	if h.upstream != u {
+		h.mu.Unlock()
+		return
+	}
+	var gaps []logGap
+	for _, sub := range h.subs {
+		if !sub.down.IsZero() {
+			gaps = append(gaps, logGap{sub: sub, gap: time.Since(sub.down)})
+			sub.down = time.Time{}
+		}
+	}
+	h.mu.Unlock()
+
+	// Pushed without the lock, as a push may block
+	for _, g := range gaps {
+		c.pushLogEntry(g.sub, LogEntry{Gap: g.gap})
+	}
+}
+
+// failLogSubscribers ends the subscribers that don't reconnect with err. It
+// returns the reconnect settings of the oldest remaining subscriber, or nil
+// once none is left, which stops u.
+func (c *Controller) failLogSubscribers(u *logUpstream, err error, brokeAt time.Time) *LogReconnect {
+	h := c.logs
+	h.mu.Lock()
+	if h.upstream != u {
+		h.mu.Unlock()
+		return nil
+	}
+
+	var (
+		reconnect *LogReconnect
+		failed    []*logSubscriber
+	)
+	kept := h.subs[:0]
+	for _, sub := range h.subs {
+		if sub.opts.reconnect == nil {
+			failed = append(failed, sub)
+			continue
+		}
+		if reconnect == nil {
+			reconnect = sub.opts.reconnect
+		}
+		if sub.down.IsZero() {
+			sub.down = brokeAt
+		}
+		kept = append(kept, sub)
+	}
+	clear(h.subs[len(kept):])
+	h.subs = kept
+
+	if reconnect == nil {
+		u.cancel()
+		h.upstream = nil
+	}
+	h.mu.Unlock()
+
+	// Pushed without the lock, as a push may block
+	for _, sub := range failed {
+		c.pushLogEntry(sub, LogEntry{Err: err})
+		sub.close()
+	}
+	return reconnect
+}
+
+// openLogSource opens a stream bound to ctx, only the opening is bounded by
+// the LogConnect timeout
+func (c *Controller) openLogSource(ctx context.Context, open LogOpener) (LogSource, error) {
+	streamCtx, cancel := context.WithCancel(ctx)
+	connectTimer := time.AfterFunc(c.Timeouts().LogConnect, cancel)
+	start := time.Now()
+	source, err := open(streamCtx)
+	if !connectTimer.Stop() {
+		if err == nil {
+			_ = source.Close()
+		}
+		err = ErrLogConnectTimeout
+	}
+	c.ObserveRequest(OpStreamLogs, start, err)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &cancelLogSource{LogSource: source, cancel: cancel}, nil
+}
+
+// readLogSource hands the lines of source to push until it fails
+func (c *Controller) readLogSource(source LogSource, push func(string)) error {
+	for {
+		line, err := source.Recv()
+		if err != nil {
+			return err
+		}
+		push(line)
+	}
+}
+
+// waitHealthy blocks until the node is Healthy and reports false if ctx is
+// done first
+func (c *Controller) waitHealthy(ctx context.Context) bool {
+	events, unsubscribe := c.SubscribeHealth(16)
+	defer unsubscribe()
+	for c.Health() != Healthy {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-events:
+		}
+	}
+	return true
+}
+
+// cancelLogSource releases the context of the stream once it is closed
+type cancelLogSource struct {
+	LogSource
+	cancel context.CancelFunc
+}
+
+func (s *cancelLogSource) Close() error {
+	defer s.cancel()
+	return s.LogSource.Close()
+}
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type fakeLogSource struct {
+	ctx    context.Context
+	lines  chan string
+	active *atomic.Int32
+}
+
+func (s *fakeLogSource) Recv() (string, error) {
+	select {
+	case <-s.ctx.Done():
+		return "", s.ctx.Err()
+	case line, ok := <-s.lines:
+		if !ok {
+			return "", io.EOF
+		}
+		return line, nil
+	}
+}
+
+func (s *fakeLogSource) Close() error {
+	s.active.Add(-1)
+	return nil
+}
+
+func TestController_LogFanOut(t *testing.T) {
+	c := New(uuid.New(), 10, nil)
+	c.Connect("node", "core")
+
+	lines := make(chan string)
+	var opened, active atomic.Int32
+	open := func(ctx context.Context) (LogSource, error) {
+		opened.Add(1)
+		active.Add(1)
+		return &fakeLogSource{ctx: ctx, lines: lines, active: &active}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	newest, _ := c.OpenLogStream(ctx, open, WithLogBuffer(2), WithDropPolicy(DropNewest))
+	oldest, _ := c.OpenLogStream(ctx, open, WithLogBuffer(2))
+	all, _ := c.OpenLogStream(ctx, open)
+
+	for _, line := range []string{"1", "2", "3"} {
+		lines <- line
+	}
+	// Subscribers are fed in order, so the last one seeing "3" means the others got it too
+	for _, want := range []string{"1", "2", "3"} {
+		if entry := <-all; entry.Line != want {
+			t.Fatalf("expected %q, got %+v", want, entry)
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		ch   <-chan LogEntry
+		want []string
+	}{
+		"DropNewest": {newest, []string{"1", "2"}},
+		"DropOldest": {oldest, []string{"2", "3"}},
+	} {
+		for _, want := range tc.want {
+			if entry := <-tc.ch; entry.Line != want {
+				t.Errorf("%s: expected %q, got %+v", name, want, entry)
+			}
+		}
+	}
+
+	if n := opened.Load(); n != 1 {
+		t.Fatalf("expected a single upstream stream, got %d", n)
+	}
+
+	cancel()
+	for _, ch := range []<-chan LogEntry{newest, oldest, all} {
+		for range ch {
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for active.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("upstream stream not closed after the last subscriber left")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestController_LogFanOutLeave(t *testing.T) {
+	c, open, lines := newFakeLogNode()
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	defer cancelFirst()
+	first, _ := c.OpenLogStream(firstCtx, open)
+	secondCtx, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	second, _ := c.OpenLogStream(secondCtx, open)
+
+	cancelFirst()
+	for range first {
+	}
+
+	// The upstream stream stays open for the second subscriber
+	lines <- "after"
+	if entry := <-second; entry.Line != "after" {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+	if stats := c.LogStats(); stats.Subscribers != 1 {
+		t.Fatalf("expected a single subscriber left, got %+v", stats)
+	}
+}
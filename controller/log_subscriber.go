@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultLogBlockTimeout = 1 * time.Second
+	DefaultLogSpillSize    = 64 << 20
+)
+
+// DropPolicy decides what happens to an entry when a subscriber's channel is full
+type DropPolicy int
+
+const (
+	// DropOldest drops the oldest entry in the channel to make room
+	DropOldest DropPolicy = iota
+	// DropNewest drops the entry that does not fit
+	DropNewest
+	// BlockWithTimeout waits for room, see WithLogBlock
+	BlockWithTimeout
+	// SpillToDisk queues entries in a file, see WithLogSpill
+	SpillToDisk
+)
+
+// WithDropPolicy sets what happens to an entry when the channel is full,
+// DropOldest by default. Every lost entry is counted in LogStats and
+// reported by an entry with Dropped set once the channel has room again.
+func WithDropPolicy(p DropPolicy) LogStreamOption {
+	return func(o *logStreamOptions) {
+		o.dropPolicy = p
+	}
+}
+
+// WithLogBlock holds back the stream for up to timeout when the channel is
+// full and drops the entry after that. Every subscriber of the node waits
+// meanwhile.
+func WithLogBlock(timeout time.Duration) LogStreamOption {
+	return func(o *logStreamOptions) {
+		o.dropPolicy = BlockWithTimeout
+		o.blockTimeout = timeout
+	}
+}
+
+// WithLogSpill queues the entries that don't fit the channel in a ring
+// buffer file of up to maxBytes in dir, the default temporary directory when
+// empty. The oldest queued entries are dropped once the file is full. The
+// file is removed when the subscription ends.
+func WithLogSpill(dir string, maxBytes int64) LogStreamOption {
+	return func(o *logStreamOptions) {
+		o.dropPolicy = SpillToDisk
+		o.spillDir = dir
+		o.spillSize = maxBytes
+	}
+}
+
+// LogStats counts the lines read from the node and the entries delivered to
+// or dropped for the subscribers, Dropped and Gap entries included
+type LogStats struct {
+	Subscribers int
+	Received    uint64
+	Delivered   uint64
+	Dropped     uint64
+}
+
+type logCounters struct {
+	received  atomic.Uint64
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// LogStats returns the log stream counters, kept across restarts
+func (c *Controller) LogStats() LogStats {
+	h := c.logs
+	h.mu.Lock()
+	subscribers := len(h.subs)
+	h.mu.Unlock()
+	return LogStats{
+		Subscribers: subscribers,
+		Received:    h.stats.received.Load(),
+		Delivered:   h.stats.delivered.Load(),
+		Dropped:     h.stats.dropped.Load(),
+	}
+}
+
+type logSubscriber struct {
+	ch   chan LogEntry
+	opts logStreamOptions
+	// down is when the upstream broke while subscribed, guarded by logHub.mu
+	down time.Time
+	// left is closed once the consumer is gone
+	left     chan struct{}
+	leftOnce sync.Once
+	spill    *logSpill
+
+	mu     sync.Mutex
+	closed bool
+	// drained is set once the spill drainer closed the channel
+	drained bool
+	stop    func() bool
+	// lost counts the entries lost since the last Dropped entry
+	lost uint64
+}
+
+func (c *Controller) newLogSubscriber(o logStreamOptions) (*logSubscriber, error) {
+	if o.dropPolicy == BlockWithTimeout && o.blockTimeout <= 0 {
+		o.blockTimeout = DefaultLogBlockTimeout
+	}
+	sub := &logSubscriber{
+		ch:   make(chan LogEntry, o.buffer),
+		opts: o,
+		left: make(chan struct{}),
+	}
+	if o.dropPolicy == SpillToDisk {
+		if o.spillSize <= 0 {
+			o.spillSize = DefaultLogSpillSize
+		}
+		ring, err := newLogRing(o.spillDir, o.spillSize)
+		if err != nil {
+			return nil, err
+		}
+		sub.spill = &logSpill{ring: ring, wake: make(chan struct{}, 1)}
+		go c.drainLogSpill(sub)
+	}
+	return sub, nil
+}
+
+// close ends the subscription once the entries already queued were delivered
+func (s *logSubscriber) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.spill != nil {
+		// The spill drainer closes the channel once it is empty, the context
+		// stays watched meanwhile in case the consumer leaves first
+		notify(s.spill.wake)
+		return
+	}
+	close(s.ch)
+	if s.stop != nil {
+		s.stop()
+	}
+}
+
+// leave gives up on delivering anything more to the consumer
+func (s *logSubscriber) leave() {
+	s.leftOnce.Do(func() { close(s.left) })
+}
+
+// lose accounts for an entry that will not reach the consumer and returns
+// the number of log lines it stood for. A Dropped entry carries its count
+// over to the next one instead.
+func (s *logSubscriber) lose(entry LogEntry) uint64 {
+	if entry.Dropped > 0 {
+		s.lost += entry.Dropped
+		return 0
+	}
+	s.lost++
+	return 1
+}
+
+// pushLogEntry hands entry to sub according to its drop policy, after an
+// entry reporting the earlier losses if there is room for it
+func (c *Controller) pushLogEntry(sub *logSubscriber, entry LogEntry) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+
+	var dropped uint64
+	if sub.lost > 0 {
+		marker := LogEntry{Dropped: sub.lost}
+		if sub.spill != nil {
+			sub.lost = 0
+			dropped += c.spillLogEntry(sub, marker)
+		} else if c.trySendLogEntry(sub, marker) {
+			sub.lost = 0
+		}
+	}
+
+	switch {
+	case sub.spill != nil:
+		dropped += c.spillLogEntry(sub, entry)
+	case c.trySendLogEntry(sub, entry):
+	case sub.opts.dropPolicy == DropOldest:
+		select {
+		case oldest := <-sub.ch:
+			dropped += sub.lose(oldest)
+		default:
+		}
+		// Non-blocking write in case the channel was filled again
+		if !c.trySendLogEntry(sub, entry) {
+			dropped += sub.lose(entry)
+		}
+	case sub.opts.dropPolicy == BlockWithTimeout:
+		timer := time.NewTimer(sub.opts.blockTimeout)
+		defer timer.Stop()
+		select {
+		case sub.ch <- entry:
+			c.logs.stats.delivered.Add(1)
+		case <-timer.C:
+			dropped += sub.lose(entry)
+		case <-sub.left:
+		}
+	default:
+		dropped += sub.lose(entry)
+	}
+
+	if dropped > 0 {
+		c.recordLogDrops(dropped)
+	}
+}
+
+func (c *Controller) trySendLogEntry(sub *logSubscriber, entry LogEntry) bool {
+	select {
+	case sub.ch <- entry:
+		c.logs.stats.delivered.Add(1)
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Controller) recordLogDrops(n uint64) {
+	c.logs.stats.dropped.Add(n)
+	c.RecordLogDrops(n)
+	c.Logger().Debug("log consumer fell behind, dropped entries", "dropped", n)
+}
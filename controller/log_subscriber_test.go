@@ -0,0 +1,243 @@
+package controller
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newFakeLogNode returns a connected controller and an opener streaming the
+// lines sent to the returned channel
+func newFakeLogNode(opts ...Option) (*Controller, LogOpener, chan<- string) {
+	c := New(uuid.New(), 10, nil, opts...)
+	c.Connect("node", "core")
+
+	lines := make(chan string)
+	var active atomic.Int32
+	open := func(ctx context.Context) (LogSource, error) {
+		active.Add(1)
+		return &fakeLogSource{ctx: ctx, lines: lines, active: &active}, nil
+	}
+	return &c, open, lines
+}
+
+// sendLogLines sends count numbered lines and waits until barrier, the last
+// subscriber, received them, which means every other subscriber did too
+func sendLogLines(t *testing.T, lines chan<- string, barrier <-chan LogEntry, count int) {
+	t.Helper()
+	go func() {
+		for i := 1; i <= count; i++ {
+			lines <- strconv.Itoa(i)
+		}
+	}()
+	for i := 1; i <= count; i++ {
+		if entry := <-barrier; entry.Line != strconv.Itoa(i) {
+			t.Fatalf("barrier: expected line %d, got %+v", i, entry)
+		}
+	}
+}
+
+func TestController_LogDropNewest(t *testing.T) {
+	c, open, lines := newFakeLogNode()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logs, _ := c.OpenLogStream(ctx, open, WithLogBuffer(1), WithDropPolicy(DropNewest))
+	barrier, _ := c.OpenLogStream(ctx, open, WithLogBuffer(100))
+
+	sendLogLines(t, lines, barrier, 3)
+	if entry := <-logs; entry.Line != "1" {
+		t.Fatalf("expected the first line, got %+v", entry)
+	}
+	if stats := c.LogStats(); stats.Dropped != 2 || stats.Received != 3 || stats.Subscribers != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// The losses are reported once there is room again
+	go func() { lines <- "4" }()
+	<-barrier
+	if entry := <-logs; entry.Dropped != 2 {
+		t.Fatalf("expected a Dropped entry, got %+v", entry)
+	}
+}
+
+func TestController_LogBlock(t *testing.T) {
+	c, open, lines := newFakeLogNode()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logs, _ := c.OpenLogStream(ctx, open, WithLogBuffer(1), WithLogBlock(time.Second))
+	go func() {
+		for i := 1; i <= 3; i++ {
+			lines <- strconv.Itoa(i)
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	for i := 1; i <= 3; i++ {
+		if entry := <-logs; entry.Line != strconv.Itoa(i) {
+			t.Fatalf("expected line %d, got %+v", i, entry)
+		}
+	}
+	if stats := c.LogStats(); stats.Dropped != 0 {
+		t.Fatalf("expected no drops, got %+v", stats)
+	}
+
+	// Without a consumer the entry is dropped after the timeout
+	logs, _ = c.OpenLogStream(ctx, open, WithLogBuffer(0), WithLogBlock(20*time.Millisecond))
+	lines <- "4"
+	time.Sleep(100 * time.Millisecond)
+	if stats := c.LogStats(); stats.Dropped != 1 {
+		t.Fatalf("expected a drop after the timeout, got %+v", stats)
+	}
+}
+
+func TestController_LogSpill(t *testing.T) {
+	c, open, lines := newFakeLogNode()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	dir := t.TempDir()
+	logs, err := c.OpenLogStream(ctx, open, WithLogBuffer(1), WithLogSpill(dir, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := c.OpenLogStream(ctx, open, WithLogBuffer(1), WithLogSpill(dir, 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	barrier, _ := c.OpenLogStream(ctx, open, WithLogBuffer(100))
+
+	sendLogLines(t, lines, barrier, 50)
+
+	// Nothing is lost when the file is large enough, and the order is kept
+	for i := 1; i <= 50; i++ {
+		if entry := <-logs; entry.Line != strconv.Itoa(i) {
+			t.Fatalf("expected line %d, got %+v", i, entry)
+		}
+	}
+
+	// A small file keeps the newest lines and reports the others as dropped
+	received, last := 0, 0
+	var reported uint64
+	for received+int(reported) < 50 {
+		entry := <-small
+		if entry.Dropped > 0 {
+			reported += entry.Dropped
+			continue
+		}
+		n, _ := strconv.Atoi(entry.Line)
+		if n <= last {
+			t.Fatalf("line %d received after line %d", n, last)
+		}
+		received, last = received+1, n
+		if n == 50 {
+			break
+		}
+	}
+	if stats := c.LogStats(); uint64(received)+stats.Dropped != 50 {
+		t.Fatalf("received %d lines, expected the rest to be dropped, got %+v", received, stats)
+	}
+
+	cancel()
+	for range small {
+	}
+	for range logs {
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatalf("expected the spill files to be removed, found %d", len(entries))
+	}
+}
+
+func TestController_LogBlockStop(t *testing.T) {
+	c, open, lines := newFakeLogNode()
+	logs, _ := c.OpenLogStream(context.Background(), open, WithLogBuffer(0), WithLogBlock(10*time.Second))
+	lines <- "1"
+
+	// The push blocked on the consumer does not hold back Stop
+	stopped := make(chan struct{})
+	go func() {
+		c.StopLogStreams()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("StopLogStreams waited for the blocked push")
+	}
+	for range logs {
+	}
+}
+
+func TestController_LogSpillStop(t *testing.T) {
+	c, open, lines := newFakeLogNode()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	dir := t.TempDir()
+	logs, _ := c.OpenLogStream(ctx, open, WithLogBuffer(1), WithLogSpill(dir, 1<<20))
+	barrier, _ := c.OpenLogStream(context.Background(), open, WithLogBuffer(100))
+	sendLogLines(t, lines, barrier, 10)
+
+	// Once stopped, the queued entries are still delivered, until the
+	// consumer leaves
+	c.StopLogStreams()
+	if entry := <-logs; entry.Line != "1" {
+		t.Fatalf("expected the first line, got %+v", entry)
+	}
+	cancel()
+
+	// The drainer gives up on the queued entries without the consumer reading
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		entries, _ := os.ReadDir(dir)
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the spill file was not removed after the consumer left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for range logs {
+	}
+}
+
+func TestController_LogSpillLeave(t *testing.T) {
+	c, open, lines := newFakeLogNode()
+	barrier, _ := c.OpenLogStream(context.Background(), open, WithLogBuffer(100))
+	go func() {
+		for range barrier {
+		}
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case lines <- "line":
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Consumers leaving while lines are pushed to them never make a push
+	// hit a closed channel
+	dir := t.TempDir()
+	for range 200 {
+		ctx, cancel := context.WithCancel(context.Background())
+		logs, err := c.OpenLogStream(ctx, open, WithLogBuffer(1), WithLogSpill(dir, 1<<16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		for range logs {
+		}
+	}
+	c.StopLogStreams()
+}
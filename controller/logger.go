@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"context"
+	"log/slog"
+)
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// WithLogger logs lifecycle events, sync retries, hard resets and log stream
+// problems to l. Without it the controller logs nothing.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// Logger returns the logger set with WithLogger or one that discards everything
+func (c *Controller) Logger() *slog.Logger {
+	if c.options.logger == nil {
+		return discardLogger
+	}
+	return c.options.logger
+}
+
+// logHealthEvent logs health changes at Info and failures at Warn
+func (c *Controller) logHealthEvent(ev *HealthEvent) {
+	level := slog.LevelInfo
+	if ev.Current == Broken || ev.Err != nil {
+		level = slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.String("previous", ev.Previous.String()),
+		slog.String("current", ev.Current.String()),
+		slog.String("reason", ev.Reason),
+	}
+	if ev.Err != nil {
+		attrs = append(attrs, slog.Any("error", ev.Err))
+	}
+	c.Logger().LogAttrs(context.Background(), level, "node health event", attrs...)
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// Operations reported to Metrics
+const (
+	OpStart               = "Start"
+	OpStop                = "Stop"
+	OpInfo                = "Info"
+	OpGetStats            = "GetStats"
+	OpGetSystemStats      = "GetSystemStats"
+	OpGetBackendStats     = "GetBackendStats"
+	OpGetUserOnlineStat   = "GetUserOnlineStat"
+	OpGetUserOnlineIpList = "GetUserOnlineIpList"
+	OpSyncUsers           = "SyncUsers"
+	OpStreamLogs          = "StreamLogs"
+)
+
+// CodeOK is the code of a successful request
+const CodeOK = "OK"
+
+// Metrics receives measurements of bridge operations, labelled with the node
+// name given to WithMetrics. Implementations must be safe for concurrent use,
+// see the metrics package for one.
+type Metrics interface {
+	// ObserveRequest records one request, code is CodeOK, a gRPC code name or
+	// an HTTP status code
+	ObserveRequest(node, operation, code string, duration time.Duration)
+	SetSyncQueueDepth(node string, depth int)
+	IncSyncRetries(node string)
+	IncHardResets(node string)
+	AddLogDrops(node string, n uint64)
+}
+
+type metricsState struct {
+	metrics Metrics
+	node    string
+}
+
+// WithMetrics reports the node's operations to m under the given node name
+func WithMetrics(m Metrics, node string) Option {
+	return func(o *options) {
+		o.metrics = &metricsState{metrics: m, node: node}
+	}
+}
+
+// ObserveRequest records a request to the node that started at start
+func (c *Controller) ObserveRequest(operation string, start time.Time, err error) {
+	if m := c.options.metrics; m != nil {
+		m.metrics.ObserveRequest(m.node, operation, ErrorCode(err), time.Since(start))
+	}
+}
+
+// RecordLogDrops records n log entries dropped because the consumer fell behind
+func (c *Controller) RecordLogDrops(n uint64) {
+	if m := c.options.metrics; m != nil {
+		m.metrics.AddLogDrops(m.node, n)
+	}
+}
+
+// ErrorCode classifies err for metrics: CodeOK for nil, the HTTP status of
+// errors carrying one, and the gRPC code name otherwise.
+func ErrorCode(err error) string {
+	if err == nil {
+		return CodeOK
+	}
+
+	var statusErr interface{ StatusCode() int }
+	if errors.As(err, &statusErr) {
+		return strconv.Itoa(statusErr.StatusCode())
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrLogConnectTimeout) {
+		return "DeadlineExceeded"
+	}
+	if errors.Is(err, context.Canceled) {
+		return "Canceled"
+	}
+	return status.Code(err).String()
+}
+
+func (m *metricsState) queueDepth(depth int) {
+	if m != nil {
+		m.metrics.SetSyncQueueDepth(m.node, depth)
+	}
+}
+
+func (m *metricsState) retry() {
+	if m != nil {
+		m.metrics.IncSyncRetries(m.node)
+	}
+}
+
+func (m *metricsState) hardReset() {
+	if m != nil {
+		m.metrics.IncHardResets(m.node)
+	}
+}
@@ -0,0 +1,417 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/pasarguard/node_bridge/common"
+)
+
+const ReasonPendingStoreFailed = "pending store failed"
+
+// DefaultCompactThreshold is the number of stale records a FilePendingStore
+// tolerates before it rewrites its file.
+const DefaultCompactThreshold = 1024
+
+// PendingStore persists queued user updates so they survive a restart of the
+// process. Put is called when users are queued, under the lock of the queue so
+// that the store sees them in order, and Sync right after, outside of it.
+// Delete is called once users reached the node and Load when syncing starts.
+// The controller never closes the store.
+type PendingStore interface {
+	Put(users []*common.User) error
+	Sync() error
+	Delete(emails []string) error
+	Load() ([]*common.User, error)
+}
+
+// WithPendingStore persists queued user updates in store and replays them
+// whenever syncing starts.
+func WithPendingStore(store PendingStore) Option {
+	return func(o *options) {
+		o.pendingStore = store
+	}
+}
+
+const (
+	recordPut    byte = 1
+	recordDelete byte = 2
+)
+
+// recordHeaderSize is the size of the op byte, the length and the checksum
+const recordHeaderSize = 9
+
+// FilePendingStore is a PendingStore backed by an append-only log. Each
+// record is an op byte, a big-endian uint32 length, a big-endian CRC-32 of
+// the op and the payload, and the payload, either a marshalled User or an
+// email. The log is rewritten with only the live users once it holds more
+// than CompactThreshold stale records.
+type FilePendingStore struct {
+	CompactThreshold int
+
+	path  string
+	file  *os.File
+	users map[string]*common.User
+	stale int
+	// size is the length of the valid part of the log, which a failed write
+	// is cut back to
+	size int64
+	// appends counts the writes to the log and synced the ones known to be
+	// on disk, so that concurrent Syncs share one fsync
+	appends uint64
+	synced  uint64
+	mu      sync.Mutex
+	syncMu  sync.Mutex
+	logger  *slog.Logger
+}
+
+// NewFilePendingStore opens or creates the log at path. A record cut short or
+// garbled by a crash is discarded with everything after it. A complete record
+// that can't be decoded is skipped.
+func NewFilePendingStore(path string) (*FilePendingStore, error) {
+	return NewFilePendingStoreWithLogger(path, nil)
+}
+
+// NewFilePendingStoreWithLogger is NewFilePendingStore logging the records it
+// skips to logger
+func NewFilePendingStoreWithLogger(path string, logger *slog.Logger) (*FilePendingStore, error) {
+	if logger == nil {
+		logger = discardLogger
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FilePendingStore{
+		CompactThreshold: DefaultCompactThreshold,
+		path:             path,
+		file:             file,
+		users:            make(map[string]*common.User),
+		logger:           logger,
+	}
+
+	s.size = s.replay()
+	if err := s.rollback(); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to load pending store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// replay reads the log into s.users and returns the size of its valid part.
+// Records that can't be decoded are counted as stale, so that the next
+// compaction drops them.
+func (s *FilePendingStore) replay() int64 {
+	r := bufio.NewReader(s.file)
+	var size int64
+	for {
+		var header [recordHeaderSize]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return size
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[1:5]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return size
+		}
+		if binary.BigEndian.Uint32(header[5:]) != recordChecksum(header[0], payload) {
+			return size
+		}
+
+		if err := s.replayRecord(header[0], payload); err != nil {
+			s.stale++
+			s.logger.Warn("skipped an undecodable pending store record", "path", s.path, "offset", size, "error", err)
+		}
+		size += int64(len(header) + len(payload))
+	}
+}
+
+func (s *FilePendingStore) replayRecord(op byte, payload []byte) error {
+	switch op {
+	case recordPut:
+		u := &common.User{}
+		if err := proto.Unmarshal(payload, u); err != nil {
+			return err
+		}
+		if _, ok := s.users[u.GetEmail()]; ok {
+			s.stale++
+		}
+		s.users[u.GetEmail()] = u
+	case recordDelete:
+		s.stale++
+		if _, ok := s.users[string(payload)]; ok {
+			s.stale++
+			delete(s.users, string(payload))
+		}
+	default:
+		return fmt.Errorf("unknown record type %d", op)
+	}
+	return nil
+}
+
+// Put appends users to the log. They are on disk once Sync returns.
+func (s *FilePendingStore) Put(users []*common.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	var buf []byte
+	for _, u := range users {
+		data, err := proto.Marshal(u)
+		if err != nil {
+			return err
+		}
+		buf = appendRecord(buf, recordPut, data)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.append(buf); err != nil {
+		return err
+	}
+	for _, u := range users {
+		if _, ok := s.users[u.GetEmail()]; ok {
+			s.stale++
+		}
+		s.users[u.GetEmail()] = u
+	}
+	return s.maybeCompact()
+}
+
+// Sync writes the records appended so far to disk. Syncs made at the same
+// time share one fsync.
+func (s *FilePendingStore) Sync() error {
+	s.mu.Lock()
+	appended := s.appends
+	s.mu.Unlock()
+	return s.sync(appended)
+}
+
+// sync makes sure the first appended writes to the log are on disk
+func (s *FilePendingStore) sync(appended uint64) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	s.mu.Lock()
+	if s.synced >= appended {
+		s.mu.Unlock()
+		return nil
+	}
+	file, target := s.file, s.appends
+	s.mu.Unlock()
+	if file == nil {
+		return os.ErrClosed
+	}
+
+	err := file.Sync()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		// The log was compacted or closed meanwhile, both sync it
+		if s.synced >= appended {
+			return nil
+		}
+		return err
+	}
+	s.synced = max(s.synced, target)
+	return nil
+}
+
+// Delete appends removal records. They are not synced to disk since losing
+// one only means sending a user twice.
+func (s *FilePendingStore) Delete(emails []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf []byte
+	for _, email := range emails {
+		if _, ok := s.users[email]; !ok {
+			continue
+		}
+		buf = appendRecord(buf, recordDelete, []byte(email))
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+
+	if err := s.append(buf); err != nil {
+		return err
+	}
+	for _, email := range emails {
+		if _, ok := s.users[email]; ok {
+			s.stale += 2
+			delete(s.users, email)
+		}
+	}
+	return s.maybeCompact()
+}
+
+func (s *FilePendingStore) Load() ([]*common.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil, os.ErrClosed
+	}
+	users := make([]*common.User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// Len returns the number of users waiting in the store
+func (s *FilePendingStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.users)
+}
+
+// Compact rewrites the log with only the live users
+func (s *FilePendingStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact()
+}
+
+func (s *FilePendingStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if err == nil {
+		s.synced = s.appends
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	return err
+}
+
+// append writes buf to the log. A failed write is cut off, so that the
+// records appended next are not lost behind a torn one. If that fails too,
+// the store is closed.
+func (s *FilePendingStore) append(buf []byte) error {
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	if _, err := s.file.Write(buf); err != nil {
+		if rollbackErr := s.rollback(); rollbackErr != nil {
+			_ = s.file.Close()
+			s.file = nil
+			return errors.Join(err, fmt.Errorf("failed to cut off the torn record: %w", rollbackErr))
+		}
+		return err
+	}
+	s.size += int64(len(buf))
+	s.appends++
+	return nil
+}
+
+// rollback truncates the log to its valid part and moves back to its end
+func (s *FilePendingStore) rollback() error {
+	if err := s.file.Truncate(s.size); err != nil {
+		return err
+	}
+	_, err := s.file.Seek(s.size, io.SeekStart)
+	return err
+}
+
+func (s *FilePendingStore) maybeCompact() error {
+	if s.CompactThreshold <= 0 || s.stale < s.CompactThreshold {
+		return nil
+	}
+	return s.compact()
+}
+
+// compact writes the live users to a temporary file and renames it over the
+// log, so a crash leaves either the old or the new log in place.
+func (s *FilePendingStore) compact() error {
+	if s.file == nil {
+		return os.ErrClosed
+	}
+
+	var buf []byte
+	for _, u := range s.users {
+		data, err := proto.Marshal(u)
+		if err != nil {
+			return err
+		}
+		buf = appendRecord(buf, recordPut, data)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	// The rename is only durable once the directory is synced
+	if err := syncDir(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	_ = s.file.Close()
+	s.file = file
+	s.stale = 0
+	s.size = int64(len(buf))
+	s.synced = s.appends
+	return nil
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func appendRecord(buf []byte, op byte, payload []byte) []byte {
+	buf = append(buf, op)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.BigEndian.AppendUint32(buf, recordChecksum(op, payload))
+	return append(buf, payload...)
+}
+
+func recordChecksum(op byte, payload []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE([]byte{op}), crc32.IEEETable, payload)
+}
+
+var _ PendingStore = (*FilePendingStore)(nil)
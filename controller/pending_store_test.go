@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/pasarguard/node_bridge/common"
+)
+
+func TestFilePendingStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pending.log")
+
+	store, err := NewFilePendingStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.CompactThreshold = 0
+
+	if err = store.Put([]*common.User{
+		{Email: "user1@example.com", Inbounds: []string{"a"}},
+		{Email: "user2@example.com", Inbounds: []string{"a"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Put([]*common.User{{Email: "user1@example.com", Inbounds: []string{"b"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Delete([]string{"user2@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record cut short by a crash is discarded
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte{recordPut, 0, 0, 1, 0, 0, 0, 0, 0, 42})
+	_ = f.Close()
+
+	store, err = NewFilePendingStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	users, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].GetEmail() != "user1@example.com" || users[0].GetInbounds()[0] != "b" {
+		t.Fatalf("unexpected users after reopening %v", users)
+	}
+
+	before, _ := os.Stat(path)
+	if err = store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Fatalf("expected compaction to shrink the log, %d -> %d", before.Size(), after.Size())
+	}
+
+	if err = store.Put([]*common.User{{Email: "user3@example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if store.Len() != 2 {
+		t.Fatalf("expected 2 users, got %d", store.Len())
+	}
+}
+
+func TestFilePendingStoreGarbled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pending.log")
+
+	store, err := NewFilePendingStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Put([]*common.User{{Email: "user1@example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+
+	// A complete record whose payload was not written is discarded
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := appendRecord(nil, recordPut, []byte("user2@example.com"))
+	clear(record[recordHeaderSize:])
+	_, _ = f.Write(record)
+	_ = f.Close()
+
+	store, err = NewFilePendingStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Len() != 1 {
+		t.Fatalf("expected the garbled record to be discarded, got %d users", store.Len())
+	}
+
+	// The records appended next are not lost behind it
+	if err = store.Put([]*common.User{{Email: "user3@example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+
+	store, err = NewFilePendingStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Len() != 2 {
+		t.Fatalf("expected 2 users after reopening, got %d", store.Len())
+	}
+}
+
+func TestFilePendingStoreUndecodable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pending.log")
+
+	// A record with a valid checksum that isn't a User, then a valid one
+	var log []byte
+	log = appendRecord(log, recordPut, []byte{0xff})
+	log = appendRecord(log, recordPut, mustMarshal(t, &common.User{Email: "user1@example.com"}))
+	if err := os.WriteFile(path, log, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewFilePendingStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Len() != 1 {
+		t.Fatalf("expected the undecodable record to be skipped, got %d users", store.Len())
+	}
+}
+
+func mustMarshal(t *testing.T, m proto.Message) []byte {
+	t.Helper()
+	data, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/pasarguard/node_bridge/common"
+)
+
+const ReasonReconcileFailed = "reconcile failed"
+
+var ErrReconcileDisabled = errors.New("reconciliation is not enabled")
+
+// ReconcileFunc pushes the full user set to the node
+type ReconcileFunc func(ctx context.Context, users []*common.User) error
+
+// WithReconcile keeps an authoritative copy of the node's users and pushes it
+// in full every interval, after the node recovers from Broken and whenever
+// Reconcile is called. An interval of zero disables the periodic push.
+func WithReconcile(interval time.Duration) Option {
+	return func(o *options) {
+		interval = max(interval, 0)
+		o.reconcile = &interval
+	}
+}
+
+// keepsUsers reports whether the controller keeps the full user set
+func (c *Controller) keepsUsers() bool {
+	return c.options.supervisor != nil || c.options.reconcile != nil
+}
+
+// Users returns the full user set the node should have, nil when neither
+// supervision nor reconciliation is enabled.
+func (c *Controller) Users() []*common.User {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.users == nil {
+		return nil
+	}
+	users := make([]*common.User, 0, len(c.users))
+	for _, u := range c.users {
+		users = append(users, u)
+	}
+	return users
+}
+
+// StartReconcile makes Reconcile push through sync and starts the periodic
+// and after-recovery pushes until ctx is done. It is a no-op when
+// reconciliation is not enabled.
+func (c *Controller) StartReconcile(ctx context.Context, sync ReconcileFunc) {
+	interval := c.options.reconcile
+	if interval == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.reconcile = sync
+	c.mu.Unlock()
+
+	events, unsubscribe := c.SubscribeHealth(16)
+
+	go func() {
+		defer unsubscribe()
+
+		var tick <-chan time.Time
+		if *interval > 0 {
+			ticker := time.NewTicker(*interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-events:
+				if ev.Previous != Broken || ev.Current != Healthy {
+					continue
+				}
+			case <-tick:
+			}
+
+			if err := c.Reconcile(ctx); err != nil && ctx.Err() == nil {
+				c.ReportError(ReasonReconcileFailed, err)
+			}
+		}
+	}()
+}
+
+// Reconcile pushes the full user set to the node right away, bypassing the
+// incremental sync queue.
+func (c *Controller) Reconcile(ctx context.Context) error {
+	if c.options.reconcile == nil {
+		return ErrReconcileDisabled
+	}
+
+	c.mu.RLock()
+	sync, recorded := c.reconcile, c.users != nil
+	c.mu.RUnlock()
+	if sync == nil {
+		return ErrSyncNotRunning
+	}
+	// Nothing to push before the start call recorded the user set
+	if !recorded {
+		return nil
+	}
+	return sync(ctx, c.Users())
+}
+
+// trackUsers keeps the full user set in line with incremental updates.
+// Users without inbounds are removed from the node, so they are dropped here too.
+func (c *Controller) trackUsers(users []*common.User) {
+	if !c.keepsUsers() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.users == nil {
+		return
+	}
+	for _, u := range users {
+		if len(u.GetInbounds()) == 0 {
+			delete(c.users, u.GetEmail())
+			continue
+		}
+		c.users[u.GetEmail()] = u
+	}
+}
+
+func (c *Controller) untrackUsers(emails []string) {
+	if !c.keepsUsers() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, email := range emails {
+		delete(c.users, email)
+	}
+}
@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/pasarguard/node_bridge/common"
+)
+
+const (
+	DefaultSupervisorInitialBackoff = 1 * time.Second
+	DefaultSupervisorMaxBackoff     = 1 * time.Minute
+)
+
+const (
+	ReasonRecovered      = "recovered"
+	ReasonRecoveryFailed = "recovery failed"
+)
+
+// Supervisor configures automatic recovery of a node. Once the node turns
+// Broken, either by a hard reset or by the health checker, it is started
+// again with the last backend and the current user set.
+// MaxAttempts of zero retries until Stop is called.
+type Supervisor struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Jitter         float64
+	MaxAttempts    int
+}
+
+// RestartFunc starts the node again without touching the supervisor
+type RestartFunc func(ctx context.Context, config string, backendType common.BackendType, users []*common.User, keepAlive uint64) error
+
+type supervisorState struct {
+	config      string
+	backendType common.BackendType
+	keepAlive   uint64
+	cancel      context.CancelFunc
+}
+
+// WithSupervisor enables automatic restart after a hard reset or a failed health check
+func WithSupervisor(s Supervisor) Option {
+	return func(o *options) {
+		if s.InitialBackoff <= 0 {
+			s.InitialBackoff = DefaultSupervisorInitialBackoff
+		}
+		if s.MaxBackoff < s.InitialBackoff {
+			s.MaxBackoff = max(DefaultSupervisorMaxBackoff, s.InitialBackoff)
+		}
+		s.Jitter = min(max(s.Jitter, 0), 1)
+		o.supervisor = &s
+	}
+}
+
+// Supervise remembers the backend and the user set the node was started with
+// and starts the supervisor if it is not running yet. The user set is kept
+// when either supervision or reconciliation is enabled, the supervisor only
+// when supervision is.
+func (c *Controller) Supervise(config string, backendType common.BackendType, users []*common.User, keepAlive uint64, restart RestartFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.keepsUsers() {
+		c.users = make(map[string]*common.User, len(users))
+		for _, u := range users {
+			c.users[u.GetEmail()] = u
+		}
+	}
+
+	policy := c.options.supervisor
+	if policy == nil {
+		return
+	}
+
+	c.supervisor.config = config
+	c.supervisor.backendType = backendType
+	c.supervisor.keepAlive = keepAlive
+
+	if c.supervisor.cancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.supervisor.cancel = cancel
+	events, unsubscribe := c.SubscribeHealth(16)
+
+	go func() {
+		defer unsubscribe()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-events:
+				if ev.Current == Broken && c.Health() == Broken {
+					c.recover(ctx, policy, restart)
+				}
+			}
+		}
+	}()
+}
+
+// StopSupervisor stops automatic recovery until the next Supervise call
+func (c *Controller) StopSupervisor() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.supervisor.cancel != nil {
+		c.supervisor.cancel()
+		c.supervisor.cancel = nil
+	}
+}
+
+func (c *Controller) recover(ctx context.Context, policy *Supervisor, restart RestartFunc) {
+	backoff := policy.InitialBackoff
+
+	c.Logger().Info("node is broken, restarting it")
+	for attempt := 1; ; attempt++ {
+		config, backendType, keepAlive := c.supervisedBackend()
+		users := c.Users()
+		err := restart(ctx, config, backendType, users, keepAlive)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			previous, current := c.healthChange()
+			c.emit(&HealthEvent{Previous: previous, Current: current, Reason: ReasonRecovered, Time: time.Now()})
+			return
+		}
+		c.Logger().Warn("node restart failed", "attempt", attempt, "error", err)
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			health := c.Health()
+			c.emit(&HealthEvent{Previous: health, Current: health, Reason: ReasonRecoveryFailed, Err: err, Time: time.Now()})
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(withJitter(backoff, policy.Jitter)):
+		}
+		backoff = nextBackoff(backoff, DefaultBackoffFactor, policy.MaxBackoff)
+	}
+}
+
+func (c *Controller) supervisedBackend() (string, common.BackendType, uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.supervisor.config, c.supervisor.backendType, c.supervisor.keepAlive
+}
@@ -2,6 +2,10 @@ package controller
 
 import (
 	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
@@ -18,38 +22,238 @@ const (
 type SyncManager struct {
 	ctx          context.Context
 	syncer       func([]*common.User) error
-	pending      map[string]*common.User
+	pending      map[string]*pendingUser
+	inflight     map[string]*pendingUser
 	mu           sync.Mutex
 	isRunning    bool
 	failureCount int
 	maxFailures  int
 	hardReset    func()
+	policy       SyncPolicy
+	updated      chan struct{}
+	flush        chan struct{}
+	delivered    map[string]userHash
+	stats        *syncCounters
+	store        PendingStore
+	storeFailed  func(error)
+	metrics      *metricsState
+	logger       *slog.Logger
 }
 
 func NewSyncManager(ctx context.Context, syncer func([]*common.User) error, hardReset func()) *SyncManager {
+	return NewSyncManagerWithPolicy(ctx, syncer, hardReset, DefaultSyncPolicy())
+}
+
+func NewSyncManagerWithPolicy(ctx context.Context, syncer func([]*common.User) error, hardReset func(), policy SyncPolicy) *SyncManager {
+	policy = policy.withDefaults()
 	return &SyncManager{
 		ctx:         ctx,
 		syncer:      syncer,
-		pending:     make(map[string]*common.User),
-		maxFailures: DefaultMaxRetries,
+		pending:     make(map[string]*pendingUser),
+		maxFailures: policy.MaxRetries,
 		hardReset:   hardReset,
+		policy:      policy,
+		updated:     make(chan struct{}, 1),
+		flush:       make(chan struct{}, 1),
+		delivered:   make(map[string]userHash),
+		stats:       &syncCounters{},
+		logger:      discardLogger,
 	}
 }
 
-func (s *SyncManager) UpdateUsers(users []*common.User) {
+// UpdateUsers queues users for the node and returns a ticket that resolves
+// once all of them were delivered or dropped.
+func (s *SyncManager) UpdateUsers(users []*common.User) *SyncTicket {
+	return s.enqueue(users, true)
+}
+
+// enqueue queues users, writing them to the pending store when persist is set
+func (s *SyncManager) enqueue(users []*common.User, persist bool) *SyncTicket {
+	ticket := newSyncTicket()
+	var queued []*common.User
+
 	s.mu.Lock()
 	for _, u := range users {
-		s.pending[u.GetEmail()] = u
+		var (
+			hash   userHash
+			hashed bool
+		)
+		if s.policy.SkipUnchanged {
+			hash, hashed = hashUser(u)
+			if hashed && s.unchangedLocked(u.GetEmail(), hash) {
+				s.stats.skipped.Add(1)
+				continue
+			}
+		}
+		s.stats.queued.Add(1)
+		queued = append(queued, u)
+
+		entry, ok := s.pending[u.GetEmail()]
+		if !ok {
+			entry = &pendingUser{}
+			s.pending[u.GetEmail()] = entry
+		}
+		entry.user = u
+		entry.hash, entry.hashed = hash, hashed
+		if !slices.Contains(entry.tickets, ticket) {
+			entry.tickets = append(entry.tickets, ticket)
+			ticket.add()
+		}
 	}
-	if !s.isRunning {
+	// Appended under the lock so the store sees updates in queue order, and
+	// synced to disk once it is released
+	persisted := false
+	if persist && s.store != nil && len(queued) > 0 {
+		if err := s.store.Put(queued); err != nil {
+			s.reportStoreError(err)
+		} else {
+			persisted = true
+		}
+	}
+	s.reportDepthLocked()
+	if len(s.pending) > 0 && !s.isRunning {
 		s.isRunning = true
 		go s.Run()
 	}
 	s.mu.Unlock()
+
+	if persisted {
+		if err := s.store.Sync(); err != nil {
+			s.reportStoreError(err)
+		}
+	}
+	ticket.seal()
+	notify(s.updated)
+	return ticket
+}
+
+// RemoveUsers queues the removal of users from the node. A removal is sent as
+// a user without proxies or inbounds, which the node treats as a deletion.
+// It shares the pending queue with UpdateUsers, so for the same email the
+// most recent call wins, whether it is an update or a removal.
+func (s *SyncManager) RemoveUsers(emails ...string) *SyncTicket {
+	users := make([]*common.User, 0, len(emails))
+	for _, email := range emails {
+		users = append(users, &common.User{Email: email})
+	}
+	return s.UpdateUsers(users)
+}
+
+// unchangedLocked reports whether a user matches the version last delivered
+// to the node and no other version of it is queued or in flight.
+func (s *SyncManager) unchangedLocked(email string, hash userHash) bool {
+	if _, ok := s.pending[email]; ok {
+		return false
+	}
+	if _, ok := s.inflight[email]; ok {
+		return false
+	}
+	delivered, ok := s.delivered[email]
+	return ok && delivered == hash
+}
+
+// Stats returns the update counters of this SyncManager
+func (s *SyncManager) Stats() SyncStats {
+	return s.stats.snapshot()
+}
+
+// PendingUsers lists the users that have not reached the node yet, sorted by
+// email. InFlight is set for users that are part of the sync in progress.
+func (s *SyncManager) PendingUsers() []PendingUser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byEmail := make(map[string]PendingUser, len(s.pending)+len(s.inflight))
+	for email, entry := range s.inflight {
+		byEmail[email] = PendingUser{Email: email, Attempts: entry.attempts, LastError: entry.lastError, InFlight: true}
+	}
+	for email, entry := range s.pending {
+		_, inFlight := byEmail[email]
+		byEmail[email] = PendingUser{Email: email, Attempts: entry.attempts, LastError: entry.lastError, InFlight: inFlight}
+	}
+
+	users := make([]PendingUser, 0, len(byEmail))
+	for _, u := range byEmail {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+	return users
+}
+
+// Flush makes a waiting Run sync the pending users right away, skipping
+// both the coalescing window and any retry backoff.
+func (s *SyncManager) Flush() {
+	s.mu.Lock()
+	running := s.isRunning
+	s.mu.Unlock()
+	if running {
+		notify(s.flush)
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// coalesce waits until the burst of updates of the next round is over: no
+// update for Debounce, MaxDelay since the start, MaxBatch users pending or
+// a Flush. It returns false if the context is done.
+func (s *SyncManager) coalesce() bool {
+	if s.policy.Debounce <= 0 && s.policy.MaxDelay <= 0 {
+		return true
+	}
+	if s.policy.MaxBatch > 0 && s.pendingCount() >= s.policy.MaxBatch {
+		return true
+	}
+
+	var quiet, deadline <-chan time.Time
+	var quietTimer *time.Timer
+	if s.policy.Debounce > 0 {
+		quietTimer = time.NewTimer(s.policy.Debounce)
+		defer quietTimer.Stop()
+		quiet = quietTimer.C
+	}
+	if s.policy.MaxDelay > 0 {
+		deadlineTimer := time.NewTimer(s.policy.MaxDelay)
+		defer deadlineTimer.Stop()
+		deadline = deadlineTimer.C
+	}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return false
+		case <-s.flush:
+			return true
+		case <-quiet:
+			return true
+		case <-deadline:
+			return true
+		case <-s.updated:
+			if s.policy.MaxBatch > 0 && s.pendingCount() >= s.policy.MaxBatch {
+				return true
+			}
+			if quietTimer != nil {
+				quietTimer.Reset(s.policy.Debounce)
+			}
+		}
+	}
+}
+
+func (s *SyncManager) pendingCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
 }
 
 func (s *SyncManager) Run() {
-	backoff := InitialBackoff
+	backoff := s.policy.InitialBackoff
+	// skipWindow is set for a retry, which already waited for its backoff,
+	// and for the users a round capped by MaxBatch left behind
+	skipWindow := false
 
 	for {
 		s.mu.Lock()
@@ -58,56 +262,178 @@ func (s *SyncManager) Run() {
 			s.mu.Unlock()
 			return
 		}
+		s.mu.Unlock()
 
-		// Drain pending users
-		users := make([]*common.User, 0, len(s.pending))
-		for _, u := range s.pending {
-			users = append(users, u)
+		// Let a burst of updates accumulate before each sync
+		if !skipWindow && !s.coalesce() {
+			s.drop()
+			return
 		}
-		// Clear pending map temporarily; we'll requeue failures
-		s.pending = make(map[string]*common.User)
+
+		s.mu.Lock()
+		// This round serves the Flush calls made before it
+		select {
+		case <-s.flush:
+		default:
+		}
+
+		// Drain pending users, at most MaxBatch of them
+		batch := s.pending
+		if limit := s.policy.MaxBatch; limit > 0 && len(batch) > limit {
+			batch = make(map[string]*pendingUser, limit)
+			for email, entry := range s.pending {
+				if len(batch) == limit {
+					break
+				}
+				batch[email] = entry
+				delete(s.pending, email)
+			}
+		} else {
+			// Clear pending map temporarily; we'll requeue failures
+			s.pending = make(map[string]*pendingUser)
+		}
+		leftBehind := len(s.pending) > 0
+		users := make([]*common.User, 0, len(batch))
+		for _, entry := range batch {
+			users = append(users, entry.user)
+		}
+		s.inflight = batch
 		s.mu.Unlock()
 
 		// Process all users (transport handles chunking)
 		err := s.syncer(users)
 
+		s.mu.Lock()
+		s.inflight = nil
 		if err != nil {
 			s.failureCount++
-			// Requeue failed users (don't overwrite newer updates)
-			s.mu.Lock()
-			for _, u := range users {
-				if _, exists := s.pending[u.GetEmail()]; !exists {
-					s.pending[u.GetEmail()] = u
+			s.metrics.retry()
+			// Requeue failed users (don't overwrite newer updates, hand
+			// them the tickets instead)
+			for email, entry := range batch {
+				entry.attempts++
+				entry.lastError = err
+				if newer, exists := s.pending[email]; exists {
+					newer.tickets = append(entry.tickets, newer.tickets...)
+					newer.attempts, newer.lastError = entry.attempts, entry.lastError
+				} else {
+					s.pending[email] = entry
 				}
 			}
-			s.mu.Unlock()
+		}
+		s.mu.Unlock()
 
+		if err != nil {
+			wait := withJitter(backoff, s.policy.Jitter)
 			if s.failureCount >= s.maxFailures {
+				s.logger.Error("user sync keeps failing, triggering hard reset",
+					"users", len(users), "failures", s.failureCount, "error", err)
 				if s.hardReset != nil {
 					s.hardReset()
 				}
 				s.failureCount = 0
+			} else {
+				s.logger.Warn("user sync failed, retrying",
+					"users", len(users), "failures", s.failureCount, "backoff", wait, "error", err)
 			}
 
 			// Exponential backoff
 			select {
 			case <-s.ctx.Done():
-				s.mu.Lock()
-				s.isRunning = false
-				s.mu.Unlock()
+				s.drop()
 				return
-			case <-time.After(backoff):
-				backoff *= 2
-				if backoff > MaxBackoff {
-					backoff = MaxBackoff
-				}
+			case <-s.flush:
+			case <-time.After(wait):
+				backoff = nextBackoff(backoff, s.policy.BackoffFactor, s.policy.MaxBackoff)
 			}
+			skipWindow = true
 			continue // Retry with backoff
 		}
 
 		// Success
+		s.mu.Lock()
+		if s.policy.SkipUnchanged {
+			for email, entry := range batch {
+				if entry.hashed {
+					s.delivered[email] = entry.hash
+				} else {
+					delete(s.delivered, email)
+				}
+			}
+		}
+		s.forgetLocked(batch)
+		s.reportDepthLocked()
+		s.mu.Unlock()
+		s.logger.Debug("users synced", "users", len(users))
+		s.stats.delivered.Add(uint64(len(batch)))
+		for _, entry := range batch {
+			entry.resolve(nil)
+		}
 		s.failureCount = 0
-		backoff = InitialBackoff
+		backoff = s.policy.InitialBackoff
+		skipWindow = leftBehind
 		// Continue loop to check if more users were added during sync
 	}
 }
+
+// reportDepthLocked reports the users queued or in flight to the metrics
+func (s *SyncManager) reportDepthLocked() {
+	s.metrics.queueDepth(len(s.pending) + len(s.inflight))
+}
+
+// replay queues the users left in the pending store by an earlier run
+func (s *SyncManager) replay() {
+	users, err := s.store.Load()
+	if err != nil {
+		s.reportStoreError(err)
+		return
+	}
+	if len(users) > 0 {
+		s.logger.Info("replaying users from the pending store", "users", len(users))
+		s.enqueue(users, false)
+	}
+}
+
+// forgetLocked removes delivered users from the pending store, unless a newer
+// version of them was queued meanwhile.
+func (s *SyncManager) forgetLocked(batch map[string]*pendingUser) {
+	if s.store == nil {
+		return
+	}
+	emails := make([]string, 0, len(batch))
+	for email := range batch {
+		if _, ok := s.pending[email]; !ok {
+			emails = append(emails, email)
+		}
+	}
+	if err := s.store.Delete(emails); err != nil {
+		s.reportStoreError(err)
+	}
+}
+
+func (s *SyncManager) reportStoreError(err error) {
+	if s.storeFailed != nil {
+		s.storeFailed(err)
+	}
+}
+
+// drop stops Run and resolves every pending user as dropped
+func (s *SyncManager) drop() {
+	s.mu.Lock()
+	dropped := s.pending
+	s.pending = make(map[string]*pendingUser)
+	s.isRunning = false
+	s.reportDepthLocked()
+	s.mu.Unlock()
+
+	if len(dropped) > 0 {
+		s.logger.Warn("sync stopped, dropping queued users", "users", len(dropped))
+	}
+	for _, entry := range dropped {
+		cause := entry.lastError
+		if cause == nil {
+			cause = s.ctx.Err()
+		}
+		entry.resolve(fmt.Errorf("%w: %w", ErrSyncDropped, cause))
+	}
+}
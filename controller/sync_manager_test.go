@@ -3,6 +3,7 @@ package controller
 import (
 	"context"
 	"errors"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -144,3 +145,334 @@ func TestSyncManager_UpdateUsers_Batching(t *testing.T) {
 		t.Errorf("expected 1 sync call for batch update, got %d", syncCount)
 	}
 }
+
+func TestSyncManager_Policy(t *testing.T) {
+	var mu sync.Mutex
+	failCount := 0
+	hardResets := 0
+
+	syncer := func(users []*common.User) error {
+		mu.Lock()
+		defer mu.Unlock()
+		failCount++
+		return errors.New("temporary failure")
+	}
+
+	hardReset := func() {
+		mu.Lock()
+		hardResets++
+		mu.Unlock()
+	}
+
+	sm := NewSyncManagerWithPolicy(context.Background(), syncer, hardReset, SyncPolicy{
+		MaxRetries:     2,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
+		Jitter:         0.5,
+	})
+	sm.UpdateUsers([]*common.User{{Email: "fail@example.com"}})
+
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if failCount < 4 {
+		t.Errorf("expected fast retries with a short backoff, got %d attempts", failCount)
+	}
+	if hardResets < 2 {
+		t.Errorf("expected a hard reset every 2 failures, got %d", hardResets)
+	}
+}
+
+func TestSyncManager_Debounce(t *testing.T) {
+	var mu sync.Mutex
+	syncCount := 0
+
+	syncer := func(users []*common.User) error {
+		mu.Lock()
+		syncCount++
+		mu.Unlock()
+		return nil
+	}
+
+	sm := NewSyncManagerWithPolicy(context.Background(), syncer, nil, SyncPolicy{Debounce: 50 * time.Millisecond})
+	sm.UpdateUsers([]*common.User{{Email: "u1@ex.com"}})
+	time.Sleep(10 * time.Millisecond)
+	sm.UpdateUsers([]*common.User{{Email: "u2@ex.com"}})
+
+	time.Sleep(150 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if syncCount != 1 {
+		t.Errorf("expected updates within the debounce window to share one sync, got %d", syncCount)
+	}
+}
+
+func TestSyncManager_CoalescingWindow(t *testing.T) {
+	var mu sync.Mutex
+	var batches []int
+
+	syncer := func(users []*common.User) error {
+		mu.Lock()
+		batches = append(batches, len(users))
+		mu.Unlock()
+		return nil
+	}
+
+	syncCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(batches)
+	}
+
+	// MaxDelay bounds a burst that never goes quiet
+	sm := NewSyncManagerWithPolicy(context.Background(), syncer, nil, SyncPolicy{
+		Debounce: 40 * time.Millisecond,
+		MaxDelay: 100 * time.Millisecond,
+	})
+	for i := 0; i < 10; i++ {
+		sm.UpdateUsers([]*common.User{{Email: string(rune('a' + i))}})
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := syncCount(); got < 2 {
+		t.Errorf("expected MaxDelay to cut the burst into several syncs, got %d", got)
+	}
+
+	// MaxBatch starts the sync as soon as enough users are pending
+	mu.Lock()
+	batches = nil
+	mu.Unlock()
+	sm = NewSyncManagerWithPolicy(context.Background(), syncer, nil, SyncPolicy{
+		Debounce: time.Hour,
+		MaxBatch: 3,
+	})
+	sm.UpdateUsers([]*common.User{{Email: "u1"}, {Email: "u2"}})
+	sm.UpdateUsers([]*common.User{{Email: "u3"}})
+	time.Sleep(50 * time.Millisecond)
+	if got := syncCount(); got != 1 {
+		t.Errorf("expected MaxBatch to trigger one sync, got %d", got)
+	}
+
+	// and caps the users of one sync, the others following right after
+	mu.Lock()
+	batches = nil
+	mu.Unlock()
+	var many []*common.User
+	for i := range 7 {
+		many = append(many, &common.User{Email: "many" + strconv.Itoa(i)})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := sm.UpdateUsers(many).Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(batches) != 3 || batches[0] != 3 || batches[1] != 3 || batches[2] != 1 {
+		t.Errorf("expected batches of at most 3 users, got %v", batches)
+	}
+	mu.Unlock()
+
+	// Flush skips the window
+	sm.UpdateUsers([]*common.User{{Email: "u4"}})
+	time.Sleep(10 * time.Millisecond)
+	sm.Flush()
+	time.Sleep(50 * time.Millisecond)
+	if got := syncCount(); got != 4 {
+		t.Errorf("expected Flush to force a sync, got %d", got)
+	}
+}
+
+func TestSyncManager_CoalesceEveryRound(t *testing.T) {
+	var mu sync.Mutex
+	var batches []int
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	syncer := func(users []*common.User) error {
+		mu.Lock()
+		batches = append(batches, len(users))
+		first := len(batches) == 1
+		mu.Unlock()
+		if first {
+			close(started)
+			<-release
+		}
+		return nil
+	}
+
+	// The updates queued during a sync and right after share the next one
+	sm := NewSyncManagerWithPolicy(context.Background(), syncer, nil, SyncPolicy{Debounce: 50 * time.Millisecond})
+	sm.UpdateUsers([]*common.User{{Email: "u1"}})
+	<-started
+	sm.UpdateUsers([]*common.User{{Email: "u2"}})
+	close(release)
+	time.Sleep(10 * time.Millisecond)
+	sm.UpdateUsers([]*common.User{{Email: "u3"}})
+	time.Sleep(150 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(batches) != 2 || batches[1] != 2 {
+		t.Errorf("expected the second round to be coalesced, got batches %v", batches)
+	}
+}
+
+func TestSyncManager_RemoveUsers(t *testing.T) {
+	var mu sync.Mutex
+	synced := make(map[string]*common.User)
+
+	syncer := func(users []*common.User) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, u := range users {
+			synced[u.GetEmail()] = u
+		}
+		return nil
+	}
+
+	sm := NewSyncManagerWithPolicy(context.Background(), syncer, nil, SyncPolicy{Debounce: 50 * time.Millisecond})
+
+	added := &common.User{Email: "added@example.com", Inbounds: []string{"vmess-in"}}
+	removed := &common.User{Email: "removed@example.com", Inbounds: []string{"vmess-in"}}
+
+	// the last call for an email wins
+	sm.UpdateUsers([]*common.User{removed})
+	sm.RemoveUsers(added.GetEmail(), removed.GetEmail())
+	sm.UpdateUsers([]*common.User{added})
+
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if u := synced[added.GetEmail()]; u == nil || len(u.GetInbounds()) != 1 {
+		t.Errorf("expected %s to be synced as an update, got %v", added.GetEmail(), u)
+	}
+	if u := synced[removed.GetEmail()]; u == nil || len(u.GetInbounds()) != 0 || u.GetProxies() != nil {
+		t.Errorf("expected %s to be synced as a removal, got %v", removed.GetEmail(), u)
+	}
+}
+
+func TestSyncManager_Tickets(t *testing.T) {
+	var mu sync.Mutex
+	failures := 2
+	syncErr := errors.New("node unavailable")
+
+	syncer := func(users []*common.User) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			return syncErr
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sm := NewSyncManagerWithPolicy(ctx, syncer, nil, SyncPolicy{InitialBackoff: 50 * time.Millisecond})
+
+	ticket := sm.UpdateUsers([]*common.User{{Email: "user1@example.com"}, {Email: "user2@example.com"}})
+	time.Sleep(20 * time.Millisecond)
+
+	pending := sm.PendingUsers()
+	if len(pending) != 2 || pending[0].Email != "user1@example.com" {
+		t.Fatalf("expected 2 pending users, got %+v", pending)
+	}
+	if pending[0].Attempts != 1 || !errors.Is(pending[0].LastError, syncErr) {
+		t.Errorf("expected 1 failed attempt, got %+v", pending[0])
+	}
+
+	// A newer update takes over the tickets of the one it supersedes
+	newer := sm.UpdateUsers([]*common.User{{Email: "user1@example.com", Inbounds: []string{"vmess-in"}}})
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), time.Second)
+	defer waitCancel()
+	if err := ticket.Wait(waitCtx); err != nil {
+		t.Fatalf("expected ticket to resolve without error, got %v", err)
+	}
+	if err := newer.Wait(waitCtx); err != nil {
+		t.Fatalf("expected newer ticket to resolve without error, got %v", err)
+	}
+	if pending = sm.PendingUsers(); len(pending) != 0 {
+		t.Errorf("expected no pending users, got %+v", pending)
+	}
+
+	// Pending users are dropped once the context ends
+	mu.Lock()
+	failures = 100
+	mu.Unlock()
+	dropped := sm.UpdateUsers([]*common.User{{Email: "user3@example.com"}})
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	if err := dropped.Wait(waitCtx); !errors.Is(err, ErrSyncDropped) || !errors.Is(err, syncErr) {
+		t.Fatalf("expected ErrSyncDropped wrapping the last sync error, got %v", err)
+	}
+}
+
+func TestSyncManager_SkipUnchanged(t *testing.T) {
+	var mu sync.Mutex
+	synced := make(map[string]int)
+
+	syncer := func(users []*common.User) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, u := range users {
+			synced[u.GetEmail()]++
+		}
+		return nil
+	}
+
+	sm := NewSyncManagerWithPolicy(context.Background(), syncer, nil, SyncPolicy{SkipUnchanged: true})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	u1 := &common.User{Email: "user1@example.com", Inbounds: []string{"a", "b"}}
+	if err := sm.UpdateUsers([]*common.User{u1}).Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same content, inbounds in another order
+	same := &common.User{Email: "user1@example.com", Inbounds: []string{"b", "a"}}
+	ticket := sm.UpdateUsers([]*common.User{same})
+	select {
+	case <-ticket.Done():
+	default:
+		t.Fatal("expected ticket of a skipped update to resolve right away")
+	}
+
+	changed := &common.User{Email: "user1@example.com", Inbounds: []string{"a"}}
+	if err := sm.UpdateUsers([]*common.User{changed}).Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	count := synced[u1.GetEmail()]
+	mu.Unlock()
+	if count != 2 {
+		t.Errorf("expected user1 to be synced twice, got %d", count)
+	}
+
+	stats := sm.Stats()
+	if stats.Queued != 2 || stats.Skipped != 1 || stats.Delivered != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// A user that can't be hashed is never skipped
+	invalid := &common.User{Email: "user2@example.com", Proxies: &common.Proxy{Vmess: &common.Vmess{Id: "\xff"}}}
+	for range 2 {
+		if err := sm.UpdateUsers([]*common.User{invalid}).Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	count = synced[invalid.GetEmail()]
+	mu.Unlock()
+	if count != 2 {
+		t.Errorf("expected user2 to be synced twice, got %d", count)
+	}
+}
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const DefaultBackoffFactor = 2
+
+// SyncPolicy tunes how SyncManager delivers user updates. MaxRetries is the
+// number of consecutive failures before a hard reset is triggered.
+//
+// Debounce, MaxDelay and MaxBatch form a coalescing window so that a burst of
+// updates shares one stream: the first sync of a burst waits until no update
+// arrived for Debounce, at most MaxDelay in total, or until MaxBatch users are
+// pending. The window is disabled when both durations are zero. MaxBatch
+// also caps the users sent in one sync, the others follow right after.
+//
+// SkipUnchanged drops updates identical to the version of the user last
+// delivered by the current sync session. The node is not asked, so a node
+// that loses its users on its own needs WithReconcile to get them back.
+type SyncPolicy struct {
+	ChunkSize      int
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	BackoffFactor  float64
+	Jitter         float64
+	Debounce       time.Duration
+	MaxDelay       time.Duration
+	MaxBatch       int
+	SkipUnchanged  bool
+}
+
+func DefaultSyncPolicy() SyncPolicy {
+	return SyncPolicy{
+		ChunkSize:      MaxChunkSize,
+		MaxRetries:     DefaultMaxRetries,
+		InitialBackoff: InitialBackoff,
+		MaxBackoff:     MaxBackoff,
+		BackoffFactor:  DefaultBackoffFactor,
+	}
+}
+
+// WithSyncPolicy overrides the default sync policy, zero fields keep their default
+func WithSyncPolicy(p SyncPolicy) Option {
+	return func(o *options) {
+		p = p.withDefaults()
+		o.syncPolicy = &p
+	}
+}
+
+func (c *Controller) SyncPolicy() SyncPolicy {
+	if c.options.syncPolicy == nil {
+		return DefaultSyncPolicy()
+	}
+	return *c.options.syncPolicy
+}
+
+func (p SyncPolicy) withDefaults() SyncPolicy {
+	defaults := DefaultSyncPolicy()
+	if p.ChunkSize <= 0 {
+		p.ChunkSize = defaults.ChunkSize
+	}
+	if p.MaxRetries <= 0 {
+		p.MaxRetries = defaults.MaxRetries
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaults.InitialBackoff
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = max(defaults.MaxBackoff, p.InitialBackoff)
+	}
+	if p.BackoffFactor < 1 {
+		p.BackoffFactor = defaults.BackoffFactor
+	}
+	p.Jitter = min(max(p.Jitter, 0), 1)
+	p.Debounce = max(p.Debounce, 0)
+	p.MaxDelay = max(p.MaxDelay, 0)
+	if p.MaxDelay > 0 && p.MaxDelay < p.Debounce {
+		p.MaxDelay = p.Debounce
+	}
+	p.MaxBatch = max(p.MaxBatch, 0)
+	return p
+}
+
+// nextBackoff grows backoff by factor, capped at limit
+func nextBackoff(backoff time.Duration, factor float64, limit time.Duration) time.Duration {
+	backoff = time.Duration(float64(backoff) * factor)
+	if backoff > limit {
+		backoff = limit
+	}
+	return backoff
+}
+
+// withJitter randomizes d by up to fraction of it in either direction
+func withJitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*fraction*float64(d))
+}
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"slices"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/pasarguard/node_bridge/common"
+)
+
+// SyncStats counts user updates since the controller was created. Skipped
+// updates were identical to the version last delivered to the node and
+// never went on the wire, see SyncPolicy.SkipUnchanged.
+type SyncStats struct {
+	Queued    uint64
+	Skipped   uint64
+	Delivered uint64
+}
+
+type syncCounters struct {
+	queued    atomic.Uint64
+	skipped   atomic.Uint64
+	delivered atomic.Uint64
+}
+
+func (c *syncCounters) snapshot() SyncStats {
+	return SyncStats{
+		Queued:    c.queued.Load(),
+		Skipped:   c.skipped.Load(),
+		Delivered: c.delivered.Load(),
+	}
+}
+
+type userHash [sha256.Size]byte
+
+// hashUser hashes the parts of a user the node acts on: its proxies and its
+// inbounds, ignoring inbound order. It returns false if the proxies can't be
+// marshalled, in which case the user can't be told unchanged.
+func hashUser(u *common.User) (userHash, bool) {
+	h := sha256.New()
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(u.GetProxies())
+	if err != nil {
+		return userHash{}, false
+	}
+	h.Write(data)
+
+	inbounds := slices.Clone(u.GetInbounds())
+	slices.Sort(inbounds)
+	for _, inbound := range inbounds {
+		h.Write([]byte{0})
+		h.Write([]byte(inbound))
+	}
+
+	var sum userHash
+	h.Sum(sum[:0])
+	return sum, true
+}
@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/pasarguard/node_bridge/common"
+)
+
+var (
+	ErrSyncDropped    = errors.New("users dropped before reaching the node")
+	ErrSyncNotRunning = errors.New("node is not syncing users")
+)
+
+// SyncTicket tracks the users queued by one UpdateUsers or RemoveUsers call.
+// It resolves once every one of them reached the node or was dropped. A user
+// superseded by a newer call for the same email resolves together with the
+// newer entry.
+type SyncTicket struct {
+	done      chan struct{}
+	mu        sync.Mutex
+	remaining int
+	err       error
+}
+
+// newSyncTicket returns a ticket held open until seal is called, so it can't
+// resolve while users are still being added to it.
+func newSyncTicket() *SyncTicket {
+	return &SyncTicket{done: make(chan struct{}), remaining: 1}
+}
+
+func failedSyncTicket(err error) *SyncTicket {
+	t := newSyncTicket()
+	t.err = err
+	close(t.done)
+	return t
+}
+
+// Done is closed once the ticket is resolved
+func (t *SyncTicket) Done() <-chan struct{} {
+	return t.done
+}
+
+// Err returns nil until the ticket is resolved, then the error of the first
+// dropped user, wrapping ErrSyncDropped, or nil if all users were delivered.
+func (t *SyncTicket) Err() error {
+	select {
+	case <-t.done:
+	default:
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Wait blocks until the ticket is resolved or ctx is done
+func (t *SyncTicket) Wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.done:
+		return t.Err()
+	}
+}
+
+func (t *SyncTicket) add() {
+	t.mu.Lock()
+	t.remaining++
+	t.mu.Unlock()
+}
+
+// seal releases the hold taken by newSyncTicket
+func (t *SyncTicket) seal() {
+	t.resolve(nil)
+}
+
+func (t *SyncTicket) resolve(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	t.remaining--
+	if t.remaining == 0 {
+		close(t.done)
+	}
+}
+
+// PendingUser describes a user that has not reached the node yet
+type PendingUser struct {
+	Email     string
+	Attempts  int
+	LastError error
+	InFlight  bool
+}
+
+type pendingUser struct {
+	user      *common.User
+	hash      userHash
+	hashed    bool
+	tickets   []*SyncTicket
+	attempts  int
+	lastError error
+}
+
+func (p *pendingUser) resolve(err error) {
+	for _, t := range p.tickets {
+		t.resolve(err)
+	}
+	p.tickets = nil
+}
@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	DefaultStartTimeout      = 15 * time.Second
+	DefaultStopTimeout       = 5 * time.Second
+	DefaultUnaryTimeout      = 5 * time.Second
+	DefaultSyncTimeout       = 30 * time.Second
+	DefaultLogConnectTimeout = 10 * time.Second
+
+	// DefaultRESTTimeout is the Stop, Unary and Sync default of the REST
+	// transport, which has always bounded its requests by 10 seconds
+	DefaultRESTTimeout = 10 * time.Second
+)
+
+var ErrLogConnectTimeout = errors.New("timed out opening log stream")
+
+// Timeouts bounds every call made to a node. Start, Stop and Unary cover
+// the whole call, Sync covers a full SyncUsers stream and LogConnect only
+// covers opening a log stream, not reading from it.
+type Timeouts struct {
+	Start      time.Duration
+	Stop       time.Duration
+	Unary      time.Duration
+	Sync       time.Duration
+	LogConnect time.Duration
+}
+
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Start:      DefaultStartTimeout,
+		Stop:       DefaultStopTimeout,
+		Unary:      DefaultUnaryTimeout,
+		Sync:       DefaultSyncTimeout,
+		LogConnect: DefaultLogConnectTimeout,
+	}
+}
+
+// DefaultRESTTimeouts returns the defaults of the REST transport. They differ
+// from DefaultTimeouts to keep the 10 second bound of its earlier releases.
+func DefaultRESTTimeouts() Timeouts {
+	t := DefaultTimeouts()
+	t.Stop = DefaultRESTTimeout
+	t.Unary = DefaultRESTTimeout
+	t.Sync = DefaultRESTTimeout
+	return t
+}
+
+// WithTimeouts overrides the default timeouts, zero fields keep their default
+func WithTimeouts(t Timeouts) Option {
+	return func(o *options) {
+		o.timeouts = &t
+	}
+}
+
+// WithDefaultTimeouts replaces DefaultTimeouts as the defaults of the fields
+// WithTimeouts leaves zero. Transports use it to set their own defaults.
+func WithDefaultTimeouts(t Timeouts) Option {
+	return func(o *options) {
+		o.defaultTimeouts = &t
+	}
+}
+
+func (c *Controller) Timeouts() Timeouts {
+	defaults := DefaultTimeouts()
+	if c.options.defaultTimeouts != nil {
+		defaults = *c.options.defaultTimeouts
+	}
+	if c.options.timeouts == nil {
+		return defaults
+	}
+
+	t := *c.options.timeouts
+	if t.Start <= 0 {
+		t.Start = defaults.Start
+	}
+	if t.Stop <= 0 {
+		t.Stop = defaults.Stop
+	}
+	if t.Unary <= 0 {
+		t.Unary = defaults.Unary
+	}
+	if t.Sync <= 0 {
+		t.Sync = defaults.Sync
+	}
+	if t.LogConnect <= 0 {
+		t.LogConnect = defaults.LogConnect
+	}
+	return t
+}
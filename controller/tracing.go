@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/pasarguard/node_bridge/tracing"
+)
+
+// WithTracer traces every call to the node and propagates the trace context
+// to it, see the tracing package.
+func WithTracer(t tracing.Tracer) Option {
+	return func(o *options) {
+		o.tracer = t
+	}
+}
+
+// Tracer returns the tracer set with WithTracer, nil when tracing is off
+func (c *Controller) Tracer() tracing.Tracer {
+	return c.options.tracer
+}
+
+// TraceSync annotates the span of a SyncUsers call with its user and chunk count
+func (c *Controller) TraceSync(ctx context.Context, users int) context.Context {
+	if c.options.tracer == nil {
+		return ctx
+	}
+	chunkSize := c.SyncPolicy().ChunkSize
+	chunks := max((users+chunkSize-1)/chunkSize, 1)
+	ctx = tracing.WithCallEvents(ctx)
+	return tracing.WithAttributes(ctx,
+		tracing.Int(tracing.KeyUserCount, users),
+		tracing.Int(tracing.KeyChunkCount, chunks),
+	)
+}
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const xrayTimeLayout = "2006/01/02 15:04:05"
+
+type XrayLogKind int
+
+const (
+	XrayAccessLog XrayLogKind = iota + 1
+	XrayErrorLog
+)
+
+// XrayLog is a parsed Xray log line. Access log lines fill Source, Network,
+// Destination, the tags, Email and Accepted, or Reason when the connection
+// was rejected. Error log lines fill Level and Message.
+type XrayLog struct {
+	Kind        XrayLogKind
+	Time        time.Time
+	Level       string
+	Source      netip.AddrPort
+	Network     string
+	Destination string
+	InboundTag  string
+	OutboundTag string
+	Email       string
+	Accepted    bool
+	Reason      string
+	Message     string
+}
+
+// WithParsedLogs fills LogEntry.Parsed for the Xray log lines of StreamLogs
+func WithParsedLogs() Option {
+	return func(o *options) {
+		o.parseLogs = true
+	}
+}
+
+// logLine builds the LogEntry of a log line, parsing it when WithParsedLogs is set
+func (c *Controller) logLine(line string) LogEntry {
+	entry := LogEntry{Line: line}
+	if c.options.parseLogs {
+		if parsed, ok := ParseXrayLog(line); ok {
+			entry.Parsed = parsed
+		}
+	}
+	return entry
+}
+
+// ParseXrayLog parses an Xray access or error log line, for example
+//
+//	2024/01/02 15:04:05.123456 from 1.2.3.4:5678 accepted tcp:example.com:443 [vmess-in >> direct] email: user
+//	2024/01/02 15:04:05 [Warning] [1234] app/dispatcher: default route for tcp:example.com:443
+//
+// Timestamps are read in the local time zone, as Xray writes them.
+func ParseXrayLog(line string) (*XrayLog, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return nil, false
+	}
+	ts, err := time.ParseInLocation(xrayTimeLayout, fields[0]+" "+fields[1], time.Local)
+	if err != nil {
+		return nil, false
+	}
+	log := &XrayLog{Time: ts}
+	rest := fields[2:]
+
+	// Error log: [Level] message
+	if level, ok := strings.CutPrefix(rest[0], "["); ok && strings.HasSuffix(level, "]") {
+		log.Kind = XrayErrorLog
+		log.Level = strings.TrimSuffix(level, "]")
+		log.Message = strings.Join(rest[1:], " ")
+		return log, true
+	}
+
+	// Access log: [from] source accepted|rejected ...
+	if rest[0] == "from" {
+		rest = rest[1:]
+	}
+	if len(rest) < 2 {
+		return nil, false
+	}
+	log.Kind = XrayAccessLog
+	log.Source = parseSource(rest[0])
+
+	switch rest[1] {
+	case "accepted":
+		log.Accepted = true
+	case "rejected":
+		log.Reason = strings.Join(rest[2:], " ")
+		return log, true
+	default:
+		return nil, false
+	}
+
+	rest = rest[2:]
+	if len(rest) > 0 {
+		log.Network, log.Destination, _ = strings.Cut(rest[0], ":")
+		if log.Destination == "" {
+			log.Network, log.Destination = "", rest[0]
+		}
+		rest = rest[1:]
+	}
+	for len(rest) > 0 {
+		switch {
+		case strings.HasPrefix(rest[0], "["):
+			// [inbound -> outbound] or [inbound >> outbound]
+			end := 0
+			for end < len(rest) && !strings.HasSuffix(rest[end], "]") {
+				end++
+			}
+			if end == len(rest) {
+				return log, true
+			}
+			route := strings.Fields(strings.Trim(strings.Join(rest[:end+1], " "), "[]"))
+			if len(route) > 0 {
+				log.InboundTag = route[0]
+			}
+			if len(route) > 2 {
+				log.OutboundTag = route[2]
+			}
+			rest = rest[end+1:]
+		case rest[0] == "email:" && len(rest) > 1:
+			log.Email = rest[1]
+			rest = rest[2:]
+		default:
+			rest = rest[1:]
+		}
+	}
+	return log, true
+}
+
+// parseSource parses 1.2.3.4:5678, [::1]:5678 or either with a network
+// prefix such as tcp:
+func parseSource(source string) netip.AddrPort {
+	if addr, err := netip.ParseAddrPort(source); err == nil {
+		return addr
+	}
+	if _, rest, ok := strings.Cut(source, ":"); ok {
+		addr, _ := netip.ParseAddrPort(rest)
+		return addr
+	}
+	return netip.AddrPort{}
+}
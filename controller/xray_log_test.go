@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParseXrayLog(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 15, 4, 5, 0, time.Local)
+
+	tests := []struct {
+		line string
+		want XrayLog
+	}{
+		{
+			line: "2024/01/02 15:04:05 1.2.3.4:5678 accepted tcp:example.com:443 [vmess-in -> direct] email: user1",
+			want: XrayLog{Kind: XrayAccessLog, Time: ts, Source: netip.MustParseAddrPort("1.2.3.4:5678"), Network: "tcp",
+				Destination: "example.com:443", InboundTag: "vmess-in", OutboundTag: "direct", Email: "user1", Accepted: true},
+		},
+		{
+			line: "2024/01/02 15:04:05.123456 from tcp:[2001:db8::1]:443 accepted udp:8.8.8.8:53 [vless-in >> block]",
+			want: XrayLog{Kind: XrayAccessLog, Time: ts.Add(123456 * time.Microsecond), Source: netip.MustParseAddrPort("[2001:db8::1]:443"),
+				Network: "udp", Destination: "8.8.8.8:53", InboundTag: "vless-in", OutboundTag: "block", Accepted: true},
+		},
+		{
+			line: "2024/01/02 15:04:05 1.2.3.4:5678 rejected  proxy/vmess/encoding: invalid user",
+			want: XrayLog{Kind: XrayAccessLog, Time: ts, Source: netip.MustParseAddrPort("1.2.3.4:5678"),
+				Reason: "proxy/vmess/encoding: invalid user"},
+		},
+		{
+			line: "2024/01/02 15:04:05 [Warning] [1234] app/dispatcher: default route",
+			want: XrayLog{Kind: XrayErrorLog, Time: ts, Level: "Warning", Message: "[1234] app/dispatcher: default route"},
+		},
+	}
+
+	for _, tt := range tests {
+		got, ok := ParseXrayLog(tt.line)
+		if !ok {
+			t.Errorf("failed to parse %q", tt.line)
+			continue
+		}
+		if !got.Time.Equal(tt.want.Time) {
+			t.Errorf("%q: expected time %v, got %v", tt.line, tt.want.Time, got.Time)
+		}
+		got.Time = tt.want.Time
+		if *got != tt.want {
+			t.Errorf("%q:\nexpected %+v\ngot      %+v", tt.line, tt.want, *got)
+		}
+	}
+
+	for _, line := range []string{"", "not a log line", "2024/01/02 15:04:05 1.2.3.4:5678 maybe"} {
+		if _, ok := ParseXrayLog(line); ok {
+			t.Errorf("expected %q not to parse", line)
+		}
+	}
+}
+
+func TestController_ParsedLogs(t *testing.T) {
+	c, open, lines := newFakeLogNode(WithParsedLogs())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logs, err := c.OpenLogStream(ctx, open)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines <- "2024/01/02 15:04:05 1.2.3.4:5678 accepted tcp:example.com:443 [vmess-in -> direct] email: user1"
+	entry := <-logs
+	if entry.Parsed == nil {
+		t.Fatalf("expected %q to be parsed", entry.Line)
+	}
+	if entry.Parsed.Email != "user1" || entry.Parsed.InboundTag != "vmess-in" || entry.Parsed.OutboundTag != "direct" {
+		t.Fatalf("unexpected parsed entry %+v", entry.Parsed)
+	}
+
+	lines <- "node started"
+	if entry := <-logs; entry.Parsed != nil {
+		t.Fatalf("expected %q to be left unparsed, got %+v", entry.Line, entry.Parsed)
+	}
+}
@@ -0,0 +1,157 @@
+// Package logarchive keeps the log of a node in rotated, optionally
+// compressed files.
+package logarchive
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	bridge "github.com/pasarguard/node_bridge"
+	"github.com/pasarguard/node_bridge/controller"
+)
+
+const (
+	DefaultBuffer = 4096
+	// DefaultRetryInterval is how long Archive waits before subscribing again
+	// once its stream ended
+	DefaultRetryInterval = 1 * time.Second
+
+	markerTimeLayout = "2006/01/02 15:04:05.000000"
+)
+
+// Archive writes the log of a node to a Writer. It subscribes with
+// WithLogReconnect and subscribes again whenever the node was stopped and
+// connects again. Gaps and dropped entries are written as Warning lines so the
+// files stay readable by controller.ParseXrayLog.
+type Archive struct {
+	node       bridge.PasarGuardNode
+	writer     *Writer
+	streamOpts []controller.LogStreamOption
+	cancel     context.CancelFunc
+	done       chan struct{}
+
+	mu      sync.Mutex
+	lastErr error
+}
+
+// Attach archives the log of node in dir, which should not be shared with
+// another node. streamOpts are applied after the defaults, a reconnecting
+// subscription with a buffer of DefaultBuffer entries.
+func Attach(node bridge.PasarGuardNode, dir string, opts Options, streamOpts ...controller.LogStreamOption) (*Archive, error) {
+	writer, err := NewWriter(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &Archive{
+		node:   node,
+		writer: writer,
+		streamOpts: append([]controller.LogStreamOption{
+			controller.WithLogReconnect(controller.LogReconnect{}),
+			controller.WithLogBuffer(DefaultBuffer),
+		}, streamOpts...),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go a.run(ctx)
+	return a, nil
+}
+
+// Writer returns the writer of the archive, for example to rotate on demand
+func (a *Archive) Writer() *Writer {
+	return a.writer
+}
+
+// LastError returns the last error writing the files, nil if there was none
+func (a *Archive) LastError() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastErr
+}
+
+// Close stops archiving and flushes the current file
+func (a *Archive) Close() error {
+	a.cancel()
+	<-a.done
+	return a.writer.Close()
+}
+
+func (a *Archive) run(ctx context.Context) {
+	defer close(a.done)
+	for {
+		logs, err := a.node.StreamLogs(ctx, a.streamOpts...)
+		if err == nil {
+			a.consume(logs)
+		}
+		if !a.waitConnected(ctx) {
+			return
+		}
+	}
+}
+
+// consume writes the entries of logs until it is closed, flushing whenever
+// it is drained
+func (a *Archive) consume(logs <-chan controller.LogEntry) {
+	for entry := range logs {
+		a.write(entry)
+		if len(logs) == 0 {
+			a.setErr(a.writer.Flush())
+		}
+	}
+	a.setErr(a.writer.Flush())
+}
+
+func (a *Archive) write(entry controller.LogEntry) {
+	var line string
+	switch {
+	case entry.Gap > 0:
+		line = marker("log stream was down for %s", entry.Gap.Round(time.Millisecond))
+	case entry.Dropped > 0:
+		line = marker("dropped %d log entries", entry.Dropped)
+	case entry.Err != nil:
+		line = marker("log stream failed: %v", entry.Err)
+	default:
+		line = entry.Line
+	}
+	a.setErr(a.writer.WriteLine(line))
+}
+
+func marker(format string, args ...any) string {
+	return time.Now().Format(markerTimeLayout) + " [Warning] node_bridge: " + fmt.Sprintf(format, args...)
+}
+
+func (a *Archive) setErr(err error) {
+	if err == nil {
+		return
+	}
+	a.mu.Lock()
+	a.lastErr = err
+	a.mu.Unlock()
+}
+
+// waitConnected waits DefaultRetryInterval and then until the node is
+// connected, it reports false if ctx is done first
+func (a *Archive) waitConnected(ctx context.Context) bool {
+	events, unsubscribe := a.node.SubscribeHealth(16)
+	defer unsubscribe()
+
+	timer := time.NewTimer(DefaultRetryInterval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+	}
+
+	for a.node.Health() == controller.NotConnected {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-events:
+		}
+	}
+	return true
+}
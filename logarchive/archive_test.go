@@ -0,0 +1,249 @@
+package logarchive
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	bridge "github.com/pasarguard/node_bridge"
+	"github.com/pasarguard/node_bridge/common"
+	"github.com/pasarguard/node_bridge/controller"
+	"github.com/pasarguard/node_bridge/nodetest"
+)
+
+func readArchived(t *testing.T, name string) string {
+	t.Helper()
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWriter(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, Options{MaxSize: 10, Compress: true, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every line fills a file, so each one rotates the previous one
+	for _, line := range []string{"line-1", "line-2", "line-3", "line-4"} {
+		if err := w.WriteLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := w.Rotated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("expected 2 backups, got %v", rotated)
+	}
+	for i, name := range rotated {
+		if !strings.HasSuffix(name, ".log.gz") {
+			t.Fatalf("expected a compressed backup, got %s", name)
+		}
+		if got, want := readArchived(t, filepath.Join(dir, name)), []string{"line-2\n", "line-3\n"}[i]; got != want {
+			t.Fatalf("backup %s holds %q, expected %q", name, got, want)
+		}
+	}
+	if got := readArchived(t, filepath.Join(dir, currentFile)); got != "line-4\n" {
+		t.Fatalf("unexpected current file %q", got)
+	}
+
+	// A new writer appends to the current file
+	w, err = NewWriter(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteLine("line-5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readArchived(t, filepath.Join(dir, currentFile)); got != "line-4\nline-5\n" {
+		t.Fatalf("unexpected current file %q", got)
+	}
+}
+
+func TestWriterRotateFailure(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.WriteLine("line-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The current file can't be renamed once it is gone
+	if err := os.Remove(filepath.Join(dir, currentFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Rotate(); err == nil {
+		t.Fatal("expected the rotation to fail")
+	}
+
+	// Writing goes on in a new current file
+	if err := w.WriteLine("line-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readArchived(t, filepath.Join(dir, currentFile)); got != "line-2\n" {
+		t.Fatalf("unexpected current file %q", got)
+	}
+}
+
+func TestWriterRetention(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, time.Now().Add(-48*time.Hour).UTC().Format(timestampLayout)+".log.gz")
+	if err := os.WriteFile(old, nil, 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWriter(dir, Options{RotateEvery: 20 * time.Millisecond, MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteLine("first"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(25 * time.Millisecond)
+	if err := w.WriteLine("second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := w.Rotated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 1 || strings.HasSuffix(rotated[0], ".gz") {
+		t.Fatalf("expected the expired backup to be replaced by an uncompressed one, got %v", rotated)
+	}
+	if got := readArchived(t, filepath.Join(dir, rotated[0])); got != "first\n" {
+		t.Fatalf("unexpected backup %q", got)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	for _, protocol := range []bridge.NodeProtocol{bridge.GRPC, bridge.REST} {
+		t.Run(string(protocol), func(t *testing.T) {
+			server, err := nodetest.New(uuid.New())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(server.Close)
+
+			var port int
+			if protocol == bridge.GRPC {
+				port, err = server.ServeGRPC()
+			} else {
+				port, err = server.ServeREST()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			node, err := bridge.New("127.0.0.1", protocol,
+				bridge.WithPort(port),
+				bridge.WithAPIKey(server.APIKey),
+				bridge.WithServerCA(server.CertPEM),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := func() {
+				t.Helper()
+				if err := node.StartContext(context.Background(), "config", common.BackendType_XRAY, nil, 60); err != nil {
+					t.Fatal(err)
+				}
+			}
+			start()
+			defer node.Stop()
+
+			dir := t.TempDir()
+			archive, err := Attach(node, dir, Options{}, controller.WithLogReconnect(controller.LogReconnect{InitialBackoff: 10 * time.Millisecond}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer archive.Close()
+
+			current := func() string {
+				data, _ := os.ReadFile(filepath.Join(dir, currentFile))
+				return string(data)
+			}
+			waitFor := func(what string, cond func() bool) {
+				t.Helper()
+				deadline := time.Now().Add(5 * time.Second)
+				for !cond() {
+					if time.Now().After(deadline) {
+						t.Fatalf("timed out waiting for %s, archived %q", what, current())
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			pushLog := func(line string) {
+				t.Helper()
+				waitFor("a log subscriber", func() bool { return server.LogSubscribers() == 1 })
+				server.PushLog(line)
+				waitFor(line, func() bool { return strings.Contains(current(), line+"\n") })
+			}
+
+			pushLog("before break")
+
+			server.CloseLogStreams()
+			pushLog("after break")
+			if !strings.Contains(current(), "[Warning] node_bridge: log stream was down for") {
+				t.Fatalf("expected a gap marker, archived %q", current())
+			}
+
+			node.Stop()
+			start()
+			pushLog("after restart")
+
+			if err := archive.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := archive.LastError(); err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(current()), "\n")
+			if lines[0] != "before break" || lines[len(lines)-1] != "after restart" {
+				t.Fatalf("unexpected archive %q", lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package logarchive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxSize = 100 << 20
+
+	currentFile     = "current.log"
+	timestampLayout = "20060102T150405.000"
+)
+
+// Options configures the files of an archive. Zero values disable the
+// corresponding limit, except MaxSize which defaults to DefaultMaxSize.
+type Options struct {
+	// MaxSize rotates the current file before it grows beyond this many bytes
+	MaxSize int64
+	// RotateEvery rotates the current file when a write falls into another
+	// period than its previous one, periods being multiples of RotateEvery
+	// since the zero time, so 24h rotates at midnight UTC
+	RotateEvery time.Duration
+	// Compress gzips rotated files
+	Compress bool
+	// MaxBackups is the number of rotated files to keep
+	MaxBackups int
+	// MaxAge removes rotated files older than this
+	MaxAge time.Duration
+}
+
+// Writer writes lines to current.log in a directory and rotates it into
+// files named after the rotation time, such as 20240102T150405.000.log.gz.
+// Lines are buffered until Flush, Rotate or Close.
+type Writer struct {
+	dir  string
+	opts Options
+
+	mu      sync.Mutex
+	file    *os.File
+	buf     *bufio.Writer
+	size    int64
+	lastLog time.Time
+
+	// archiveMu serializes the compression and pruning of rotated files
+	archiveMu sync.Mutex
+	archiving sync.WaitGroup
+}
+
+// NewWriter creates dir if needed and appends to the current.log in it
+func NewWriter(dir string, opts Options) (*Writer, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	w := &Writer{dir: dir, opts: opts}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	file, err := os.OpenFile(filepath.Join(w.dir, currentFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	w.file = file
+	w.buf = bufio.NewWriter(file)
+	w.size = info.Size()
+	w.lastLog = info.ModTime()
+	return nil
+}
+
+// WriteLine writes line followed by a newline. A line never spans two files.
+// If rotating the current file fails, the line is still written to it and the
+// error is returned.
+func (w *Writer) WriteLine(line string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return os.ErrClosed
+	}
+
+	n := int64(len(line) + 1)
+	now := time.Now()
+	var rotateErr error
+	if w.size > 0 && (w.size+n > w.opts.MaxSize || w.periodChanged(now)) {
+		rotateErr = w.rotate(now)
+		if w.file == nil {
+			return rotateErr
+		}
+	}
+
+	if _, err := w.buf.WriteString(line); err != nil {
+		return errors.Join(rotateErr, err)
+	}
+	if err := w.buf.WriteByte('\n'); err != nil {
+		return errors.Join(rotateErr, err)
+	}
+	w.size += n
+	w.lastLog = now
+	return rotateErr
+}
+
+func (w *Writer) periodChanged(now time.Time) bool {
+	every := w.opts.RotateEvery
+	return every > 0 && !now.Truncate(every).Equal(w.lastLog.Truncate(every))
+}
+
+// Flush writes the buffered lines to the current file
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	return w.buf.Flush()
+}
+
+// Rotate starts a new current file right away, unless the current one is empty
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	if w.size == 0 {
+		return nil
+	}
+	return w.rotate(time.Now())
+}
+
+// rotate renames the current file and opens a new one. Whatever fails after
+// the flush, current.log is opened again, so that writing goes on in the
+// current file if it could not be renamed. The writer is only left closed if
+// that fails too.
+func (w *Writer) rotate(now time.Time) error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	err := w.file.Close()
+	w.file = nil
+
+	var rotated string
+	if err == nil {
+		rotated, err = w.rotatedName(now)
+	}
+	if err == nil {
+		err = os.Rename(filepath.Join(w.dir, currentFile), rotated)
+		if err == nil {
+			w.archiving.Add(1)
+			go func() {
+				defer w.archiving.Done()
+				w.archive(rotated)
+			}()
+		}
+	}
+	if openErr := w.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// rotatedName returns a free name for a file rotated at now
+func (w *Writer) rotatedName(now time.Time) (string, error) {
+	for i := 0; i < 1000; i++ {
+		name := filepath.Join(w.dir, now.UTC().Format(timestampLayout)+".log")
+		if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+			if _, err := os.Stat(name + ".gz"); errors.Is(err, os.ErrNotExist) {
+				return name, nil
+			}
+		}
+		now = now.Add(time.Millisecond)
+	}
+	return "", fmt.Errorf("no free name to rotate %s", w.dir)
+}
+
+// archive compresses a rotated file if needed and applies the retention
+// limits. Errors leave the files as they are.
+func (w *Writer) archive(rotated string) {
+	w.archiveMu.Lock()
+	defer w.archiveMu.Unlock()
+	if w.opts.Compress {
+		_ = compress(rotated)
+	}
+	_ = w.prune(time.Now())
+}
+
+func compress(name string) (err error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(dst.Name())
+		}
+	}()
+
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// Rotated lists the rotated files, oldest first
+func (w *Writer) Rotated() ([]string, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if _, ok := rotatedTime(entry.Name()); ok {
+			names = append(names, entry.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func rotatedTime(name string) (time.Time, bool) {
+	stamp, ok := strings.CutSuffix(strings.TrimSuffix(name, ".gz"), ".log")
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(timestampLayout, stamp)
+	return t, err == nil
+}
+
+// prune removes the rotated files beyond MaxBackups or older than MaxAge
+func (w *Writer) prune(now time.Time) error {
+	if w.opts.MaxBackups <= 0 && w.opts.MaxAge <= 0 {
+		return nil
+	}
+
+	names, err := w.Rotated()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i, name := range names {
+		t, _ := rotatedTime(name)
+		expired := w.opts.MaxAge > 0 && now.Sub(t) > w.opts.MaxAge
+		excess := w.opts.MaxBackups > 0 && len(names)-i > w.opts.MaxBackups
+		if expired || excess {
+			errs = append(errs, os.Remove(filepath.Join(w.dir, name)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close flushes the current file and waits for rotated files to be archived
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	var err error
+	if w.file != nil {
+		err = errors.Join(w.buf.Flush(), w.file.Close())
+		w.file = nil
+	}
+	w.mu.Unlock()
+
+	w.archiving.Wait()
+	return err
+}
@@ -0,0 +1,251 @@
+// Package metrics provides a dependency-free controller.Metrics
+// implementation that serves the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pasarguard/node_bridge/controller"
+)
+
+const namespace = "pasarguard_bridge"
+
+// DefaultBuckets are the request latency histogram buckets, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+type requestKey struct {
+	node, operation string
+}
+
+type errorKey struct {
+	node, operation, code string
+}
+
+type histogram struct {
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+// Registry collects bridge metrics of any number of nodes. It can be passed
+// to several nodes at once, each under its own name.
+type Registry struct {
+	buckets    []float64
+	requests   map[requestKey]*histogram
+	errors     map[errorKey]uint64
+	queueDepth map[string]int
+	retries    map[string]uint64
+	hardResets map[string]uint64
+	logDrops   map[string]uint64
+	mu         sync.Mutex
+}
+
+// New creates an empty registry. Without buckets DefaultBuckets is used.
+func New(buckets ...float64) *Registry {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &Registry{
+		buckets:    buckets,
+		requests:   make(map[requestKey]*histogram),
+		errors:     make(map[errorKey]uint64),
+		queueDepth: make(map[string]int),
+		retries:    make(map[string]uint64),
+		hardResets: make(map[string]uint64),
+		logDrops:   make(map[string]uint64),
+	}
+}
+
+func (r *Registry) ObserveRequest(node, operation, code string, duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := requestKey{node: node, operation: operation}
+	h, ok := r.requests[key]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(r.buckets))}
+		r.requests[key] = h
+	}
+	seconds := duration.Seconds()
+	h.count++
+	h.sum += seconds
+	for i, bound := range r.buckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+
+	if code != controller.CodeOK {
+		r.errors[errorKey{node: node, operation: operation, code: code}]++
+	}
+}
+
+func (r *Registry) SetSyncQueueDepth(node string, depth int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queueDepth[node] = depth
+}
+
+func (r *Registry) IncSyncRetries(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retries[node]++
+}
+
+func (r *Registry) IncHardResets(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hardResets[node]++
+}
+
+func (r *Registry) AddLogDrops(node string, n uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logDrops[node] += n
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	requestKeys := make([]requestKey, 0, len(r.requests))
+	for key := range r.requests {
+		requestKeys = append(requestKeys, key)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		a, b := requestKeys[i], requestKeys[j]
+		return a.node < b.node || a.node == b.node && a.operation < b.operation
+	})
+
+	cw.header("requests_total", "counter", "Requests sent to nodes.")
+	for _, key := range requestKeys {
+		cw.sample("requests_total", labels("node", key.node, "operation", key.operation), float64(r.requests[key].count))
+	}
+
+	errorKeys := make([]errorKey, 0, len(r.errors))
+	for key := range r.errors {
+		errorKeys = append(errorKeys, key)
+	}
+	sort.Slice(errorKeys, func(i, j int) bool {
+		a, b := errorKeys[i], errorKeys[j]
+		if a.node != b.node {
+			return a.node < b.node
+		}
+		if a.operation != b.operation {
+			return a.operation < b.operation
+		}
+		return a.code < b.code
+	})
+
+	cw.header("request_errors_total", "counter", "Failed requests by gRPC code or HTTP status.")
+	for _, key := range errorKeys {
+		cw.sample("request_errors_total", labels("node", key.node, "operation", key.operation, "code", key.code), float64(r.errors[key]))
+	}
+
+	cw.header("request_duration_seconds", "histogram", "Latency of requests sent to nodes.")
+	for _, key := range requestKeys {
+		h := r.requests[key]
+		base := labels("node", key.node, "operation", key.operation)
+		for i, bound := range r.buckets {
+			cw.sample("request_duration_seconds_bucket", base+`,le="`+formatFloat(bound)+`"`, float64(h.buckets[i]))
+		}
+		cw.sample("request_duration_seconds_bucket", base+`,le="+Inf"`, float64(h.count))
+		cw.sample("request_duration_seconds_sum", base, h.sum)
+		cw.sample("request_duration_seconds_count", base, float64(h.count))
+	}
+
+	cw.header("sync_queue_depth", "gauge", "Users queued or in flight to a node.")
+	for _, node := range sortedKeys(r.queueDepth) {
+		cw.sample("sync_queue_depth", labels("node", node), float64(r.queueDepth[node]))
+	}
+	cw.nodeCounter("sync_retries_total", "Failed user syncs that were queued for a retry.", r.retries)
+	cw.nodeCounter("hard_resets_total", "Hard resets triggered by repeated sync failures.", r.hardResets)
+	cw.nodeCounter("log_drops_total", "Log entries dropped because the consumer fell behind.", r.logDrops)
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics, so the registry can be mounted as /metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) printf(format string, args ...any) {
+	if cw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(cw.w, format, args...)
+	cw.n += int64(n)
+	cw.err = err
+}
+
+func (cw *countingWriter) header(name, typ, help string) {
+	cw.printf("# HELP %s_%s %s\n# TYPE %s_%s %s\n", namespace, name, help, namespace, name, typ)
+}
+
+func (cw *countingWriter) sample(name, labels string, value float64) {
+	cw.printf("%s_%s{%s} %s\n", namespace, name, labels, formatFloat(value))
+}
+
+func (cw *countingWriter) nodeCounter(name, help string, values map[string]uint64) {
+	cw.header(name, "counter", help)
+	for _, node := range sortedKeys(values) {
+		cw.sample(name, labels("node", node), float64(values[node]))
+	}
+}
+
+// labels formats name/value pairs, escaping the values
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var _ controller.Metrics = (*Registry)(nil)
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pasarguard/node_bridge/controller"
+)
+
+func TestRegistry(t *testing.T) {
+	r := New(0.1, 1)
+
+	r.ObserveRequest("node-1", controller.OpInfo, controller.CodeOK, 50*time.Millisecond)
+	r.ObserveRequest("node-1", controller.OpInfo, "Unavailable", 500*time.Millisecond)
+	r.ObserveRequest(`node"2`, controller.OpStart, "503", 2*time.Second)
+	r.SetSyncQueueDepth("node-1", 3)
+	r.IncSyncRetries("node-1")
+	r.IncHardResets("node-1")
+	r.AddLogDrops("node-1", 1)
+	r.AddLogDrops("node-1", 500)
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+
+	for _, line := range []string{
+		"# TYPE pasarguard_bridge_requests_total counter",
+		`pasarguard_bridge_requests_total{node="node-1",operation="Info"} 2`,
+		`pasarguard_bridge_request_errors_total{node="node-1",operation="Info",code="Unavailable"} 1`,
+		`pasarguard_bridge_request_errors_total{node="node\"2",operation="Start",code="503"} 1`,
+		`pasarguard_bridge_request_duration_seconds_bucket{node="node-1",operation="Info",le="0.1"} 1`,
+		`pasarguard_bridge_request_duration_seconds_bucket{node="node-1",operation="Info",le="1"} 2`,
+		`pasarguard_bridge_request_duration_seconds_bucket{node="node\"2",operation="Start",le="+Inf"} 1`,
+		`pasarguard_bridge_request_duration_seconds_sum{node="node-1",operation="Info"} 0.55`,
+		`pasarguard_bridge_sync_queue_depth{node="node-1"} 3`,
+		`pasarguard_bridge_sync_retries_total{node="node-1"} 1`,
+		`pasarguard_bridge_hard_resets_total{node="node-1"} 1`,
+		`pasarguard_bridge_log_drops_total{node="node-1"} 501`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in output:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, `code="OK"`) {
+		t.Error("successful requests must not be counted as errors")
+	}
+}
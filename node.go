@@ -3,6 +3,10 @@ package gozargah_node_bridge
 import (
 	"context"
 	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
 
 	"github.com/google/uuid"
 
@@ -10,23 +14,46 @@ import (
 	"github.com/pasarguard/node_bridge/controller"
 	"github.com/pasarguard/node_bridge/rest"
 	"github.com/pasarguard/node_bridge/rpc"
+	"github.com/pasarguard/node_bridge/tracing"
 )
 
+// PasarGuardNode is a connection to a single node. The Context variants bind
+// the call to the caller's deadline and cancellation; outgoing gRPC metadata
+// attached to the context is forwarded to the node, as headers over REST.
 type PasarGuardNode interface {
 	Start(string, common.BackendType, []*common.User, uint64) error
+	StartContext(context.Context, string, common.BackendType, []*common.User, uint64) error
 	Stop()
+	StopContext(context.Context)
 	NodeVersion() string
 	CoreVersion() string
 	SyncUsers(users []*common.User) error
+	SyncUsersContext(ctx context.Context, users []*common.User) error
 	Info() (*common.BaseInfoResponse, error)
+	InfoContext(context.Context) (*common.BaseInfoResponse, error)
 	GetSystemStats() (*common.SystemStatsResponse, error)
+	GetSystemStatsContext(context.Context) (*common.SystemStatsResponse, error)
 	GetBackendStats() (*common.BackendStatsResponse, error)
+	GetBackendStatsContext(context.Context) (*common.BackendStatsResponse, error)
 	GetStats(reset bool, name string, statType common.StatType) (*common.StatResponse, error)
+	GetStatsContext(ctx context.Context, reset bool, name string, statType common.StatType) (*common.StatResponse, error)
 	GetUserOnlineStat(string) (*common.OnlineStatResponse, error)
+	GetUserOnlineStatContext(context.Context, string) (*common.OnlineStatResponse, error)
 	GetUserOnlineIpList(string) (*common.StatsOnlineIpListResponse, error)
+	GetUserOnlineIpListContext(context.Context, string) (*common.StatsOnlineIpListResponse, error)
 	Health() controller.Health
-	UpdateUsers([]*common.User)
-	StreamLogs(context.Context) (<-chan controller.LogEntry, error)
+	LastHealthError() error
+	LastHealthCheck() time.Time
+	SubscribeHealth(int) (<-chan controller.HealthEvent, func())
+	UpdateUsers([]*common.User) *controller.SyncTicket
+	RemoveUsers(...string) *controller.SyncTicket
+	PendingUsers() []controller.PendingUser
+	SyncStats() controller.SyncStats
+	FlushUsers()
+	Reconcile(context.Context) error
+	Users() []*common.User
+	StreamLogs(context.Context, ...controller.LogStreamOption) (<-chan controller.LogEntry, error)
+	LogStats() controller.LogStats
 	HardReset() <-chan struct{}
 }
 
@@ -46,6 +73,10 @@ type NodeOptions struct {
 	extra        map[string]interface{}
 	nodeProtocol NodeProtocol
 	logChanSize  int
+	controller   []controller.Option
+	metrics      controller.Metrics
+	metricsName  string
+	logger       *slog.Logger
 }
 
 // NodeOption is a function type for configuring NodeOptions
@@ -97,6 +128,159 @@ func WithLogChannelSize(size int) NodeOption {
 	}
 }
 
+// WithHealthCheck enables a background prober that calls Info on the given
+// interval and marks the node Broken after failureThreshold consecutive
+// failures and Healthy again after successThreshold consecutive successes.
+// A zero interval is derived from the keepAlive passed to Start.
+func WithHealthCheck(interval time.Duration, failureThreshold, successThreshold int) NodeOption {
+	return func(opts *NodeOptions) error {
+		if interval < 0 {
+			return errors.New("health check interval must not be negative")
+		}
+		if failureThreshold < 0 || successThreshold < 0 {
+			return errors.New("health check thresholds must not be negative")
+		}
+		opts.controller = append(opts.controller, controller.WithHealthCheck(controller.HealthCheck{
+			Interval:         interval,
+			FailureThreshold: failureThreshold,
+			SuccessThreshold: successThreshold,
+		}))
+		return nil
+	}
+}
+
+// WithSupervisor restarts the node with its last backend and current users
+// whenever it turns Broken, waiting between attempts with an exponential
+// backoff from initialBackoff up to maxBackoff, randomized by jitter (0 to 1).
+// A maxAttempts of zero retries until Stop is called.
+func WithSupervisor(initialBackoff, maxBackoff time.Duration, jitter float64, maxAttempts int) NodeOption {
+	return func(opts *NodeOptions) error {
+		if initialBackoff < 0 || maxBackoff < 0 {
+			return errors.New("supervisor backoff must not be negative")
+		}
+		if jitter < 0 || jitter > 1 {
+			return errors.New("supervisor jitter must be between 0 and 1")
+		}
+		if maxAttempts < 0 {
+			return errors.New("supervisor max attempts must not be negative")
+		}
+		opts.controller = append(opts.controller, controller.WithSupervisor(controller.Supervisor{
+			InitialBackoff: initialBackoff,
+			MaxBackoff:     maxBackoff,
+			Jitter:         jitter,
+			MaxAttempts:    maxAttempts,
+		}))
+		return nil
+	}
+}
+
+// WithTimeouts overrides the per-operation timeouts of both transports.
+// Zero fields keep the default of the transport, controller.DefaultTimeouts
+// for gRPC and controller.DefaultRESTTimeouts for REST.
+func WithTimeouts(timeouts controller.Timeouts) NodeOption {
+	return func(opts *NodeOptions) error {
+		if timeouts.Start < 0 || timeouts.Stop < 0 || timeouts.Unary < 0 || timeouts.Sync < 0 || timeouts.LogConnect < 0 {
+			return errors.New("timeouts must not be negative")
+		}
+		opts.controller = append(opts.controller, controller.WithTimeouts(timeouts))
+		return nil
+	}
+}
+
+// WithSyncPolicy tunes chunk size, retries before hard reset, backoff, jitter
+// and the coalescing window of user syncing. Zero fields keep their default, see
+// controller.DefaultSyncPolicy.
+func WithSyncPolicy(policy controller.SyncPolicy) NodeOption {
+	return func(opts *NodeOptions) error {
+		if policy.ChunkSize < 0 || policy.MaxRetries < 0 {
+			return errors.New("sync chunk size and retries must not be negative")
+		}
+		if policy.MaxBatch < 0 {
+			return errors.New("sync max batch must not be negative")
+		}
+		if policy.InitialBackoff < 0 || policy.MaxBackoff < 0 || policy.Debounce < 0 || policy.MaxDelay < 0 {
+			return errors.New("sync durations must not be negative")
+		}
+		if policy.Jitter < 0 || policy.Jitter > 1 {
+			return errors.New("sync jitter must be between 0 and 1")
+		}
+		opts.controller = append(opts.controller, controller.WithSyncPolicy(policy))
+		return nil
+	}
+}
+
+// WithReconcile keeps the full user set and pushes it to the node every
+// interval and after the node recovers from Broken. An interval of zero only
+// pushes after recovery and on Reconcile calls.
+func WithReconcile(interval time.Duration) NodeOption {
+	return func(opts *NodeOptions) error {
+		if interval < 0 {
+			return errors.New("reconcile interval must not be negative")
+		}
+		opts.controller = append(opts.controller, controller.WithReconcile(interval))
+		return nil
+	}
+}
+
+// WithPendingStore persists queued user updates so they survive a restart of
+// the process, see controller.NewFilePendingStore. Each node needs its own store.
+func WithPendingStore(store controller.PendingStore) NodeOption {
+	return func(opts *NodeOptions) error {
+		if store == nil {
+			return errors.New("pending store is nil")
+		}
+		opts.controller = append(opts.controller, controller.WithPendingStore(store))
+		return nil
+	}
+}
+
+// WithMetrics reports the node's requests, sync queue and log drops to m,
+// see the metrics package. An empty name labels the node with its address and port.
+func WithMetrics(m controller.Metrics, name string) NodeOption {
+	return func(opts *NodeOptions) error {
+		if m == nil {
+			return errors.New("metrics is nil")
+		}
+		opts.metrics = m
+		opts.metricsName = name
+		return nil
+	}
+}
+
+// WithTracer starts a span for every call to the node and propagates its
+// context to the node, see the tracing package.
+func WithTracer(t tracing.Tracer) NodeOption {
+	return func(opts *NodeOptions) error {
+		if t == nil {
+			return errors.New("tracer is nil")
+		}
+		opts.controller = append(opts.controller, controller.WithTracer(t))
+		return nil
+	}
+}
+
+// WithLogger logs what the node does in the background, such as health
+// changes, sync retries, hard resets and log stream failures, to l with node
+// and protocol attributes.
+func WithLogger(l *slog.Logger) NodeOption {
+	return func(opts *NodeOptions) error {
+		if l == nil {
+			return errors.New("logger is nil")
+		}
+		opts.logger = l
+		return nil
+	}
+}
+
+// WithParsedLogs parses the Xray access and error log lines of StreamLogs
+// into LogEntry.Parsed
+func WithParsedLogs() NodeOption {
+	return func(opts *NodeOptions) error {
+		opts.controller = append(opts.controller, controller.WithParsedLogs())
+		return nil
+	}
+}
+
 // New creates a new node with the given address, protocol, and options
 func New(address string, nodeProtocol NodeProtocol, options ...NodeOption) (PasarGuardNode, error) {
 	if address == "" {
@@ -117,13 +301,25 @@ func New(address string, nodeProtocol NodeProtocol, options ...NodeOption) (Pasa
 		}
 	}
 
+	if opts.logger != nil {
+		logger := opts.logger.With("node", net.JoinHostPort(opts.address, strconv.Itoa(opts.port)), "protocol", string(nodeProtocol))
+		opts.controller = append(opts.controller, controller.WithLogger(logger))
+	}
+	if opts.metrics != nil {
+		name := opts.metricsName
+		if name == "" {
+			name = net.JoinHostPort(opts.address, strconv.Itoa(opts.port))
+		}
+		opts.controller = append(opts.controller, controller.WithMetrics(opts.metrics, name))
+	}
+
 	var node PasarGuardNode
 	var err error
 	switch nodeProtocol {
 	case GRPC:
-		node, err = rpc.New(opts.address, opts.port, opts.serverCA, opts.apiKey, opts.logChanSize, opts.extra)
+		node, err = rpc.New(opts.address, opts.port, opts.serverCA, opts.apiKey, opts.logChanSize, opts.extra, opts.controller...)
 	case REST:
-		node, err = rest.New(opts.address, opts.port, opts.serverCA, opts.apiKey, opts.logChanSize, opts.extra)
+		node, err = rest.New(opts.address, opts.port, opts.serverCA, opts.apiKey, opts.logChanSize, opts.extra, opts.controller...)
 	default:
 		return nil, errors.New("unknown node protocol")
 	}
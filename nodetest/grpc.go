@@ -0,0 +1,163 @@
+package nodetest
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/pasarguard/node_bridge/common"
+)
+
+type grpcService struct {
+	common.UnimplementedNodeServiceServer
+	s *Server
+}
+
+// ServeGRPC starts a gRPC listener on a random local port and returns the port.
+func (s *Server) ServeGRPC() (int, error) {
+	lis, port, err := s.listen()
+	if err != nil {
+		return 0, err
+	}
+
+	srv := grpc.NewServer(
+		grpc.Creds(credentials.NewServerTLSFromCert(&s.cert)),
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := s.authorize(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := s.authorize(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	common.RegisterNodeServiceServer(srv, &grpcService{s: s})
+
+	go func() { _ = srv.Serve(lis) }()
+	s.addCloser(srv.Stop)
+
+	return port, nil
+}
+
+func (s *Server) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := md.Get("x-api-key")
+	if len(keys) == 0 || keys[0] != s.APIKey.String() {
+		return status.Error(codes.Unauthenticated, "invalid api key")
+	}
+	return nil
+}
+
+func (g *grpcService) Start(ctx context.Context, req *common.Backend) (*common.BaseInfoResponse, error) {
+	if err := g.s.call(ctx, MethodStart); err != nil {
+		return nil, err
+	}
+	return g.s.start(req), nil
+}
+
+func (g *grpcService) Stop(ctx context.Context, _ *common.Empty) (*common.Empty, error) {
+	if err := g.s.call(ctx, MethodStop); err != nil {
+		return nil, err
+	}
+	g.s.stop()
+	return &common.Empty{}, nil
+}
+
+func (g *grpcService) GetBaseInfo(ctx context.Context, _ *common.Empty) (*common.BaseInfoResponse, error) {
+	if err := g.s.call(ctx, MethodGetBaseInfo); err != nil {
+		return nil, err
+	}
+	return g.s.info(), nil
+}
+
+func (g *grpcService) GetLogs(_ *common.Empty, stream grpc.ServerStreamingServer[common.Log]) error {
+	if err := g.s.call(stream.Context(), MethodGetLogs); err != nil {
+		return err
+	}
+
+	ch, unsubscribe := g.s.subscribeLogs()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case line, ok := <-ch:
+			if !ok {
+				return status.Error(codes.Unavailable, "log stream closed")
+			}
+			if err := stream.Send(&common.Log{Detail: line}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (g *grpcService) GetSystemStats(ctx context.Context, _ *common.Empty) (*common.SystemStatsResponse, error) {
+	if err := g.s.call(ctx, MethodGetSystemStats); err != nil {
+		return nil, err
+	}
+	return systemStats(), nil
+}
+
+func (g *grpcService) GetBackendStats(ctx context.Context, _ *common.Empty) (*common.BackendStatsResponse, error) {
+	if err := g.s.call(ctx, MethodGetBackendStats); err != nil {
+		return nil, err
+	}
+	return g.s.backendStats(), nil
+}
+
+func (g *grpcService) GetStats(ctx context.Context, req *common.StatRequest) (*common.StatResponse, error) {
+	if err := g.s.call(ctx, MethodGetStats); err != nil {
+		return nil, err
+	}
+	return g.s.getStats(req), nil
+}
+
+func (g *grpcService) GetUserOnlineStats(ctx context.Context, req *common.StatRequest) (*common.OnlineStatResponse, error) {
+	if err := g.s.call(ctx, MethodGetUserOnlineStats); err != nil {
+		return nil, err
+	}
+	return g.s.userOnlineStat(req.GetName())
+}
+
+func (g *grpcService) GetUserOnlineIpListStats(ctx context.Context, req *common.StatRequest) (*common.StatsOnlineIpListResponse, error) {
+	if err := g.s.call(ctx, MethodGetUserOnlineIpListStats); err != nil {
+		return nil, err
+	}
+	return g.s.userOnlineIPs(req.GetName())
+}
+
+func (g *grpcService) SyncUsersChunked(stream grpc.ClientStreamingServer[common.UsersChunk, common.Empty]) error {
+	if err := g.s.call(stream.Context(), MethodSyncUsersChunked); err != nil {
+		return err
+	}
+
+	var users []*common.User
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		users = append(users, chunk.GetUsers()...)
+		if chunk.GetLast() {
+			break
+		}
+	}
+
+	g.s.syncUsers(users)
+	return stream.SendAndClose(&common.Empty{})
+}
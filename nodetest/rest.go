@@ -0,0 +1,266 @@
+package nodetest
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/pasarguard/node_bridge/common"
+)
+
+// ServeREST starts an HTTPS (HTTP/2) listener on a random local port and
+// returns the port.
+func (s *Server) ServeREST() (int, error) {
+	lis, port, err := s.listen()
+	if err != nil {
+		return 0, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /start", s.handleStart)
+	mux.HandleFunc("PUT /stop", s.handleStop)
+	mux.HandleFunc("GET /info", s.handleInfo)
+	mux.HandleFunc("GET /logs", s.handleLogs)
+	mux.HandleFunc("GET /stats", s.handleStats)
+	mux.HandleFunc("GET /stats/system", s.handleSystemStats)
+	mux.HandleFunc("GET /stats/backend", s.handleBackendStats)
+	mux.HandleFunc("GET /stats/user/online", s.handleUserOnline)
+	mux.HandleFunc("GET /stats/user/online_ip", s.handleUserOnlineIPs)
+	mux.HandleFunc("PUT /users/sync/chunked", s.handleSyncChunked)
+
+	srv := &http.Server{
+		Handler: s.restAuth(mux),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{s.cert},
+			NextProtos:   []string{"h2"},
+		},
+	}
+
+	go func() { _ = srv.ServeTLS(lis, "", "") }()
+	s.addCloser(func() { _ = srv.Close() })
+
+	return port, nil
+}
+
+func (s *Server) restAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-api-key") != s.APIKey.String() {
+			http.Error(w, "invalid api key", http.StatusUnauthorized)
+			return
+		}
+
+		md := metadata.MD{}
+		for key, values := range r.Header {
+			md.Append(key, values...)
+		}
+		next.ServeHTTP(w, r.WithContext(metadata.NewIncomingContext(r.Context(), md)))
+	})
+}
+
+func (s *Server) handleStart(w http.ResponseWriter, r *http.Request) {
+	var req common.Backend
+	if !readProto(w, r, &req) {
+		return
+	}
+	if err := s.call(r.Context(), MethodStart); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeProto(w, s.start(&req))
+}
+
+func (s *Server) handleStop(w http.ResponseWriter, r *http.Request) {
+	if err := s.call(r.Context(), MethodStop); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.stop()
+	writeProto(w, &common.Empty{})
+}
+
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	if err := s.call(r.Context(), MethodGetBaseInfo); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeProto(w, s.info())
+}
+
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if err := s.call(r.Context(), MethodGetLogs); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch, unsubscribe := s.subscribeLogs()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case line, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := io.WriteString(w, line+"\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	var req common.StatRequest
+	if !readProto(w, r, &req) {
+		return
+	}
+	if err := s.call(r.Context(), MethodGetStats); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeProto(w, s.getStats(&req))
+}
+
+func (s *Server) handleSystemStats(w http.ResponseWriter, r *http.Request) {
+	if err := s.call(r.Context(), MethodGetSystemStats); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeProto(w, systemStats())
+}
+
+func (s *Server) handleBackendStats(w http.ResponseWriter, r *http.Request) {
+	if err := s.call(r.Context(), MethodGetBackendStats); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeProto(w, s.backendStats())
+}
+
+func (s *Server) handleUserOnline(w http.ResponseWriter, r *http.Request) {
+	var req common.StatRequest
+	if !readProto(w, r, &req) {
+		return
+	}
+	if err := s.call(r.Context(), MethodGetUserOnlineStats); err != nil {
+		writeError(w, err)
+		return
+	}
+	resp, err := s.userOnlineStat(req.GetName())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeProto(w, resp)
+}
+
+func (s *Server) handleUserOnlineIPs(w http.ResponseWriter, r *http.Request) {
+	var req common.StatRequest
+	if !readProto(w, r, &req) {
+		return
+	}
+	if err := s.call(r.Context(), MethodGetUserOnlineIpListStats); err != nil {
+		writeError(w, err)
+		return
+	}
+	resp, err := s.userOnlineIPs(req.GetName())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeProto(w, resp)
+}
+
+func (s *Server) handleSyncChunked(w http.ResponseWriter, r *http.Request) {
+	if err := s.call(r.Context(), MethodSyncUsersChunked); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var users []*common.User
+	for {
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(r.Body, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		data := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+		if _, err := io.ReadFull(r.Body, data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var chunk common.UsersChunk
+		if err := proto.Unmarshal(data, &chunk); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		users = append(users, chunk.GetUsers()...)
+		if chunk.GetLast() {
+			break
+		}
+	}
+
+	s.syncUsers(users)
+	writeProto(w, &common.Empty{})
+}
+
+func readProto(w http.ResponseWriter, r *http.Request, msg proto.Message) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if err = proto.Unmarshal(body, msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeProto(w http.ResponseWriter, msg proto.Message) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch status.Code(err) {
+	case codes.NotFound:
+		code = http.StatusNotFound
+	case codes.Unauthenticated:
+		code = http.StatusUnauthorized
+	case codes.Unavailable:
+		code = http.StatusServiceUnavailable
+	case codes.InvalidArgument:
+		code = http.StatusBadRequest
+	}
+	http.Error(w, status.Convert(err).Message(), code)
+}
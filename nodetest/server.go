@@ -0,0 +1,502 @@
+// Package nodetest provides an in-process fake PasarGuard node that speaks
+// both the gRPC and the REST protocol, so bridge code can be exercised
+// without a real node, certificates on disk or network access.
+package nodetest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/pasarguard/node_bridge/common"
+)
+
+const (
+	NodeVersion = "nodetest"
+	CoreVersion = "0.0.0-fake"
+)
+
+// Method names used to inject failures. They match the gRPC method names,
+// REST routes are mapped onto the same names.
+const (
+	MethodStart                    = "Start"
+	MethodStop                     = "Stop"
+	MethodGetBaseInfo              = "GetBaseInfo"
+	MethodGetLogs                  = "GetLogs"
+	MethodGetSystemStats           = "GetSystemStats"
+	MethodGetBackendStats          = "GetBackendStats"
+	MethodGetStats                 = "GetStats"
+	MethodGetUserOnlineStats       = "GetUserOnlineStats"
+	MethodGetUserOnlineIpListStats = "GetUserOnlineIpListStats"
+	MethodSyncUsersChunked         = "SyncUsersChunked"
+)
+
+// Server is a fake node. Its state is shared by the gRPC and REST listeners,
+// so a single Server can back both transports at once.
+type Server struct {
+	APIKey  uuid.UUID
+	CertPEM []byte
+
+	cert      tls.Certificate
+	mu        sync.Mutex
+	started   bool
+	startedAt time.Time
+	backend   *common.Backend
+	users     map[string]*common.User
+	stats     map[string]int64
+	online    map[string]int64
+	onlineIPs map[string]map[string]int64
+	failures  map[string]error
+	delays    map[string]time.Duration
+	calls     map[string]int
+	metadata  map[string]metadata.MD
+	logSubs   map[chan string]struct{}
+	closers   []func()
+}
+
+// New creates a fake node that accepts the given API key and serves with a
+// freshly generated self-signed certificate for 127.0.0.1 and localhost.
+func New(apiKey uuid.UUID) (*Server, error) {
+	certPEM, keyPEM, err := generateCert()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		APIKey:    apiKey,
+		CertPEM:   certPEM,
+		cert:      cert,
+		users:     make(map[string]*common.User),
+		stats:     make(map[string]int64),
+		online:    make(map[string]int64),
+		onlineIPs: make(map[string]map[string]int64),
+		failures:  make(map[string]error),
+		delays:    make(map[string]time.Duration),
+		calls:     make(map[string]int),
+		metadata:  make(map[string]metadata.MD),
+		logSubs:   make(map[chan string]struct{}),
+	}, nil
+}
+
+// Close shuts down every listener started on the server.
+func (s *Server) Close() {
+	s.mu.Lock()
+	closers := s.closers
+	s.closers = nil
+	for ch := range s.logSubs {
+		close(ch)
+		delete(s.logSubs, ch)
+	}
+	s.mu.Unlock()
+
+	for _, c := range closers {
+		c()
+	}
+}
+
+func (s *Server) listen() (net.Listener, int, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, 0, err
+	}
+	return lis, lis.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (s *Server) addCloser(c func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closers = append(s.closers, c)
+}
+
+// SetFailure makes every following call of method fail with err until
+// ClearFailure is called. Plain errors are reported as codes.Internal.
+func (s *Server) SetFailure(method string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method] = err
+}
+
+func (s *Server) ClearFailure(method string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failures, method)
+}
+
+// SetDelay makes every following call of method wait for d, or until the
+// caller gives up, before it is handled.
+func (s *Server) SetDelay(method string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delays[method] = d
+}
+
+// Metadata returns the request metadata of the last call of method. Over REST
+// it holds the request headers, with lower-case keys.
+func (s *Server) Metadata(method string) metadata.MD {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metadata[method].Copy()
+}
+
+// Calls returns how many times method has been invoked, failed calls included.
+func (s *Server) Calls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[method]
+}
+
+func (s *Server) Started() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.started
+}
+
+// Backend returns the last backend passed to Start.
+func (s *Server) Backend() *common.Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.backend == nil {
+		return nil
+	}
+	return proto.Clone(s.backend).(*common.Backend)
+}
+
+// Users returns the users currently known by the node, sorted by email.
+func (s *Server) Users() []*common.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make([]*common.User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, proto.Clone(u).(*common.User))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].GetEmail() < users[j].GetEmail() })
+	return users
+}
+
+func (s *Server) User(email string) (*common.User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[email]
+	if !ok {
+		return nil, false
+	}
+	return proto.Clone(u).(*common.User), true
+}
+
+// Crash simulates a node restarting by itself: it stops and forgets every user.
+func (s *Server) Crash() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = false
+	s.users = make(map[string]*common.User)
+}
+
+// Restart simulates the node restarting on its own: the backend is running
+// again but every user and traffic counter is lost.
+func (s *Server) Restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = true
+	s.startedAt = time.Now()
+	s.users = make(map[string]*common.User)
+	clear(s.stats)
+}
+
+// AddUserTraffic increases the uplink and downlink counters of a user.
+func (s *Server) AddUserTraffic(email string, uplink, downlink int64) {
+	s.addTraffic("user", email, uplink, downlink)
+}
+
+// AddInboundTraffic increases the uplink and downlink counters of an inbound.
+func (s *Server) AddInboundTraffic(tag string, uplink, downlink int64) {
+	s.addTraffic("inbound", tag, uplink, downlink)
+}
+
+// AddOutboundTraffic increases the uplink and downlink counters of an outbound.
+func (s *Server) AddOutboundTraffic(tag string, uplink, downlink int64) {
+	s.addTraffic("outbound", tag, uplink, downlink)
+}
+
+func (s *Server) addTraffic(kind, name string, uplink, downlink int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats[kind+">>>"+name+">>>traffic>>>uplink"] += uplink
+	s.stats[kind+">>>"+name+">>>traffic>>>downlink"] += downlink
+}
+
+// SetOnline sets the number of online connections of a user.
+func (s *Server) SetOnline(email string, count int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.online[email] = count
+}
+
+// SetOnlineIPs sets the online ip list of a user.
+func (s *Server) SetOnlineIPs(email string, ips map[string]int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onlineIPs[email] = ips
+}
+
+// PushLog delivers a log line to every connected log stream.
+func (s *Server) PushLog(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.logSubs {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// LogSubscribers returns the number of currently open log streams.
+func (s *Server) LogSubscribers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.logSubs)
+}
+
+// CloseLogStreams ends every connected log stream, as a node dropping the
+// connections would.
+func (s *Server) CloseLogStreams() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.logSubs {
+		close(ch)
+		delete(s.logSubs, ch)
+	}
+}
+
+func (s *Server) subscribeLogs() (chan string, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan string, 100)
+	s.logSubs[ch] = struct{}{}
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.logSubs[ch]; ok {
+			delete(s.logSubs, ch)
+			close(ch)
+		}
+	}
+}
+
+// call records the invocation of method, applies the injected delay and
+// returns the injected failure, if any.
+func (s *Server) call(ctx context.Context, method string) error {
+	s.mu.Lock()
+	s.calls[method]++
+	s.metadata[method], _ = metadata.FromIncomingContext(ctx)
+	delay := s.delays[method]
+	s.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-time.After(delay):
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failures[method]; err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+	if method != MethodStart && method != MethodStop && method != MethodGetBaseInfo && !s.started {
+		return status.Error(codes.Unavailable, "node is not started")
+	}
+	return nil
+}
+
+func (s *Server) start(backend *common.Backend) *common.BaseInfoResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.started = true
+	s.startedAt = time.Now()
+	s.backend = proto.Clone(backend).(*common.Backend)
+	s.users = make(map[string]*common.User)
+	for _, u := range backend.GetUsers() {
+		s.users[u.GetEmail()] = proto.Clone(u).(*common.User)
+	}
+	return s.baseInfo()
+}
+
+func (s *Server) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = false
+}
+
+func (s *Server) info() *common.BaseInfoResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.baseInfo()
+}
+
+func (s *Server) baseInfo() *common.BaseInfoResponse {
+	return &common.BaseInfoResponse{Started: s.started, NodeVersion: NodeVersion, CoreVersion: CoreVersion}
+}
+
+// syncUsers upserts the given users; a user without inbounds is removed.
+func (s *Server) syncUsers(users []*common.User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range users {
+		if len(u.GetInbounds()) == 0 {
+			delete(s.users, u.GetEmail())
+			continue
+		}
+		s.users[u.GetEmail()] = proto.Clone(u).(*common.User)
+	}
+}
+
+func (s *Server) getStats(req *common.StatRequest) *common.StatResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var prefix string
+	switch req.GetType() {
+	case common.StatType_Outbounds:
+		prefix = "outbound>>>"
+	case common.StatType_Outbound:
+		prefix = "outbound>>>" + req.GetName() + ">>>"
+	case common.StatType_Inbounds:
+		prefix = "inbound>>>"
+	case common.StatType_Inbound:
+		prefix = "inbound>>>" + req.GetName() + ">>>"
+	case common.StatType_UsersStat:
+		prefix = "user>>>"
+	case common.StatType_UserStat:
+		prefix = "user>>>" + req.GetName() + ">>>"
+	}
+
+	names := make([]string, 0, len(s.stats))
+	for name := range s.stats {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	resp := &common.StatResponse{}
+	for _, name := range names {
+		parts := strings.Split(name, ">>>")
+		resp.Stats = append(resp.Stats, &common.Stat{
+			Name:  parts[1],
+			Type:  parts[0],
+			Link:  parts[3],
+			Value: s.stats[name],
+		})
+		if req.GetReset_() {
+			s.stats[name] = 0
+		}
+	}
+	return resp
+}
+
+func (s *Server) userOnlineStat(email string) (*common.OnlineStatResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count, ok := s.online[email]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	return &common.OnlineStatResponse{Name: email, Value: count}, nil
+}
+
+func (s *Server) userOnlineIPs(email string) (*common.StatsOnlineIpListResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ips, ok := s.onlineIPs[email]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	copied := make(map[string]int64, len(ips))
+	for ip, ts := range ips {
+		copied[ip] = ts
+	}
+	return &common.StatsOnlineIpListResponse{Name: email, Ips: copied}, nil
+}
+
+func systemStats() *common.SystemStatsResponse {
+	return &common.SystemStatsResponse{MemTotal: 1 << 30, MemUsed: 1 << 28, CpuCores: 2, CpuUsage: 12.5, Uptime: 60}
+}
+
+// backendStats reports the uptime of the backend since the last Start or
+// Restart
+func (s *Server) backendStats() *common.BackendStatsResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var uptime uint32
+	if !s.startedAt.IsZero() {
+		uptime = uint32(time.Since(s.startedAt) / time.Second)
+	}
+	return &common.BackendStatsResponse{NumGoroutine: 8, Alloc: 1 << 20, Uptime: uptime}
+}
+
+func generateCert() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
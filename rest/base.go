@@ -11,11 +11,13 @@ import (
 	"sync"
 	"time"
 
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/pasarguard/node_bridge/common"
 	"github.com/pasarguard/node_bridge/controller"
 	"github.com/pasarguard/node_bridge/tools"
+	"github.com/pasarguard/node_bridge/tracing"
 )
 
 type Node struct {
@@ -25,9 +27,11 @@ type Node struct {
 	baseUrl    string
 	cancelFunc context.CancelFunc
 	mu         sync.Mutex
+	// ctxMu guards ctx for the requests made outside mu
+	ctxMu sync.RWMutex
 }
 
-func New(address string, port int, serverCA []byte, apiKey uuid.UUID, logChanSize int, extra map[string]interface{}) (*Node, error) {
+func New(address string, port int, serverCA []byte, apiKey uuid.UUID, logChanSize int, extra map[string]interface{}, opts ...controller.Option) (*Node, error) {
 	certPool, err := tools.LoadClientPool(serverCA)
 	if err != nil {
 		return nil, err
@@ -35,20 +39,43 @@ func New(address string, port int, serverCA []byte, apiKey uuid.UUID, logChanSiz
 
 	ctx, cancel := context.WithCancel(context.Background())
 
+	// Timeouts are applied per request through the context
+	client := tools.CreateHTTPClient(certPool, address)
+	client.Timeout = 0
+
 	n := &Node{
-		Controller: controller.New(apiKey, logChanSize, extra),
-		client:     tools.CreateHTTPClient(certPool, address),
+		Controller: controller.New(apiKey, logChanSize, extra, append([]controller.Option{controller.WithDefaultTimeouts(controller.DefaultRESTTimeouts())}, opts...)...),
+		client:     client,
 		ctx:        ctx,
 		baseUrl:    "https://" + net.JoinHostPort(address, fmt.Sprintf("%d", port)),
 		cancelFunc: cancel,
 	}
 
+	if tracer := n.Tracer(); tracer != nil {
+		client.Transport = tracing.RoundTripper(tracer, client.Transport,
+			tracing.String(tracing.KeyServerAddress, net.JoinHostPort(address, fmt.Sprintf("%d", port))),
+			tracing.String(tracing.KeyProtocol, "rest"),
+		)
+	}
+
 	return n, nil
 }
 
 func (n *Node) Start(config string, backendType common.BackendType, users []*common.User, keepAlive uint64) error {
+	return n.StartContext(context.Background(), config, backendType, users, keepAlive)
+}
+
+func (n *Node) StartContext(ctx context.Context, config string, backendType common.BackendType, users []*common.User, keepAlive uint64) error {
+	if err := n.start(ctx, config, backendType, users, keepAlive); err != nil {
+		return err
+	}
+	n.Supervise(config, backendType, users, keepAlive, n.start)
+	return nil
+}
+
+func (n *Node) start(ctx context.Context, config string, backendType common.BackendType, users []*common.User, keepAlive uint64) error {
 	if n.Health() != controller.NotConnected {
-		n.Stop()
+		n.stop(ctx)
 	}
 
 	n.mu.Lock()
@@ -61,64 +88,140 @@ func (n *Node) Start(config string, backendType common.BackendType, users []*com
 		KeepAlive: keepAlive,
 	}
 
-	n.client.Timeout = time.Second * 15
 	var info common.BaseInfoResponse
-	if err := n.createRequest(n.client, "POST", "start", data, &info); err != nil {
+	if err := n.createRequest(ctx, controller.OpStart, n.Timeouts().Start, "POST", "start", data, &info); err != nil {
+		n.ReportError(controller.ReasonStartFailed, err)
 		return err
 	}
 
-	n.Connect(info.GetNodeVersion(), info.GetCoreVersion())
-	n.client.Timeout = time.Second * 10
+	// The start was cancelled, by a Stop during a supervised restart for
+	// instance, so the node must not be left running
+	if err := ctx.Err(); err != nil {
+		_ = n.createRequest(context.WithoutCancel(ctx), controller.OpStop, n.Timeouts().Stop, "PUT", "stop", &common.Empty{}, &common.Empty{})
+		return err
+	}
 
-	n.ctx, n.cancelFunc = context.WithCancel(context.Background())
+	n.Connect(info.GetNodeVersion(), info.GetCoreVersion())
 
 	n.StartSync(n.ctx, n.SyncUsers)
+	n.StartHealthCheck(n.ctx, keepAlive, n.InfoContext)
+	n.StartReconcile(n.ctx, n.SyncUsersContext)
 
 	return nil
 }
 
 func (n *Node) Stop() {
+	n.StopContext(context.Background())
+}
+
+func (n *Node) StopContext(ctx context.Context) {
+	n.StopSupervisor()
+	n.StopLogStreams()
+	n.stop(ctx)
+}
+
+func (n *Node) stop(ctx context.Context) {
+	// Checked under the lock so a start in progress is waited for
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	if n.Health() == controller.NotConnected {
 		return
 	}
-	n.mu.Lock()
-	defer n.mu.Unlock()
 
 	n.cancelFunc()
 	n.Disconnect()
-	_ = n.createRequest(n.client, "PUT", "stop", &common.Empty{}, &common.Empty{})
+
+	n.ctxMu.Lock()
+	n.ctx, n.cancelFunc = context.WithCancel(context.Background())
+	n.ctxMu.Unlock()
+
+	if err := n.createRequest(ctx, controller.OpStop, n.Timeouts().Stop, "PUT", "stop", &common.Empty{}, &common.Empty{}); err != nil {
+		n.ReportError(controller.ReasonStopFailed, err)
+	}
 }
 
 func (n *Node) Info() (*common.BaseInfoResponse, error) {
+	return n.InfoContext(context.Background())
+}
+
+func (n *Node) InfoContext(ctx context.Context) (*common.BaseInfoResponse, error) {
 	var info common.BaseInfoResponse
-	if err := n.createRequest(n.client, "GET", "info", &common.Empty{}, &info); err != nil {
+	if err := n.createRequest(ctx, controller.OpInfo, n.Timeouts().Unary, "GET", "info", &common.Empty{}, &info); err != nil {
 		return nil, err
 	}
 
 	return &info, nil
 }
 
-func (n *Node) createRequest(client *http.Client, method, endpoint string, data proto.Message, response proto.Message) error {
+// lifetime returns the context cancelled on Stop
+func (n *Node) lifetime() context.Context {
+	n.ctxMu.RLock()
+	defer n.ctxMu.RUnlock()
+	return n.ctx
+}
+
+// newRequest builds a request bound to the caller's context that is cancelled
+// on Stop too. Outgoing gRPC metadata of ctx is forwarded as headers so both
+// transports carry the same tracing data. A zero timeout adds no deadline.
+func (n *Node) newRequest(ctx context.Context, timeout time.Duration, method, endpoint string, body io.Reader) (*http.Request, context.CancelFunc, error) {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	stop := context.AfterFunc(n.lifetime(), cancel)
+	release := func() {
+		stop()
+		cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, n.baseUrl+"/"+endpoint, body)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		for key, values := range md {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+	}
+	req.Header.Set("x-api-key", n.ApiKey())
+
+	return req, release, nil
+}
+
+// createRequest sends a unary request and reports it to the metrics as op
+func (n *Node) createRequest(ctx context.Context, op string, timeout time.Duration, method, endpoint string, data proto.Message, response proto.Message) (err error) {
+	defer func(start time.Time) { n.ObserveRequest(op, start, err) }(time.Now())
+
 	body, err := proto.Marshal(data)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest(method, n.baseUrl+"/"+endpoint, bytes.NewBuffer(body))
+	req, cancel, err := n.newRequest(ctx, timeout, method, endpoint, bytes.NewBuffer(body))
 	if err != nil {
 		return err
 	}
-	req.Header.Set("x-api-key", n.ApiKey())
+	defer cancel()
 	if body != nil {
 		req.Header.Set("Content-Type", "application/x-protobuf")
 	}
 
-	do, err := client.Do(req)
+	do, err := n.client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer do.Body.Close()
 
+	if do.StatusCode != http.StatusOK {
+		return &StatusError{Code: do.StatusCode}
+	}
+
 	responseBody, _ := io.ReadAll(do.Body)
 	if err = proto.Unmarshal(responseBody, response); err != nil {
 		return err
@@ -126,22 +229,47 @@ func (n *Node) createRequest(client *http.Client, method, endpoint string, data
 	return nil
 }
 
-func (n *Node) createStreamingRequest(client *http.Client, method, endpoint string) (io.ReadCloser, error) {
-	req, err := http.NewRequest(method, n.baseUrl+"/"+endpoint, nil)
+func (n *Node) createStreamingRequest(ctx context.Context, method, endpoint string) (io.ReadCloser, error) {
+	req, cancel, err := n.newRequest(ctx, 0, method, endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("x-api-key", n.ApiKey())
 
-	resp, err := client.Do(req)
+	resp, err := n.client.Do(req)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
+		defer cancel()
 		defer resp.Body.Close()
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, &StatusError{Code: resp.StatusCode}
 	}
 
-	return resp.Body, nil
+	return &streamBody{ReadCloser: resp.Body, cancel: cancel}, nil
+}
+
+// StatusError is returned when the node answers with a status other than 200
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.Code)
+}
+
+func (e *StatusError) StatusCode() int {
+	return e.Code
+}
+
+// streamBody releases the request context once the stream is closed
+type streamBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *streamBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
 }
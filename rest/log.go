@@ -3,76 +3,43 @@ package rest
 import (
 	"bufio"
 	"context"
-	"errors"
+	"io"
 	"strings"
 
 	"github.com/pasarguard/node_bridge/controller"
 )
 
-func (n *Node) StreamLogs(ctx context.Context) (<-chan controller.LogEntry, error) {
-	if n.Health() == controller.NotConnected {
-		return nil, errors.New("node not connected")
-	}
-
-	logChan := make(chan controller.LogEntry, n.LogChanSize())
+func (n *Node) StreamLogs(ctx context.Context, opts ...controller.LogStreamOption) (<-chan controller.LogEntry, error) {
+	return n.OpenLogStream(ctx, n.openLogs, opts...)
+}
 
-	go func() {
-		defer close(logChan)
+// openLogs opens the logs stream, bound to ctx and to the node's lifetime
+func (n *Node) openLogs(ctx context.Context) (controller.LogSource, error) {
+	body, err := n.createStreamingRequest(ctx, "GET", "logs")
+	if err != nil {
+		return nil, err
+	}
+	return &logSource{body: body, reader: bufio.NewReader(body)}, nil
+}
 
-		// Create a separate client for streaming (timeout = 0)
-		client := *n.client
-		client.Timeout = 0
+type logSource struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+}
 
-		reader, err := n.createStreamingRequest(&client, "GET", "logs")
+// Recv returns the next non-empty line
+func (s *logSource) Recv() (string, error) {
+	for {
+		line, err := s.reader.ReadString('\n')
 		if err != nil {
-			pushLogEntry(logChan, controller.LogEntry{Err: err})
-			return
+			return "", err
 		}
-		defer reader.Close()
-
-		// Close reader when context is done
-		go func() {
-			select {
-			case <-ctx.Done():
-			case <-n.ctx.Done():
-			}
-			reader.Close()
-		}()
-
-		bufReader := bufio.NewReader(reader)
-
-		for {
-			line, err := bufReader.ReadString('\n')
-			if err != nil {
-				if ctx.Err() == nil && n.ctx.Err() == nil {
-					pushLogEntry(logChan, controller.LogEntry{Err: err})
-				}
-				return
-			}
-
-			line = strings.TrimSpace(line)
-			if line != "" {
-				pushLogEntry(logChan, controller.LogEntry{Line: line})
-			}
+		if line = strings.TrimSpace(line); line != "" {
+			return line, nil
 		}
-	}()
-
-	return logChan, nil
+	}
 }
 
-func pushLogEntry(ch chan controller.LogEntry, entry controller.LogEntry) {
-	select {
-	case ch <- entry:
-	default:
-		// Drop oldest
-		select {
-		case <-ch:
-		default:
-		}
-		// Non-blocking write to avoid deadlock if channel was emptied between selects
-		select {
-		case ch <- entry:
-		default:
-		}
-	}
+func (s *logSource) Close() error {
+	return s.body.Close()
 }
@@ -1,12 +1,19 @@
 package rest
 
 import (
+	"context"
+
 	"github.com/pasarguard/node_bridge/common"
+	"github.com/pasarguard/node_bridge/controller"
 )
 
 func (n *Node) GetSystemStats() (*common.SystemStatsResponse, error) {
+	return n.GetSystemStatsContext(context.Background())
+}
+
+func (n *Node) GetSystemStatsContext(ctx context.Context) (*common.SystemStatsResponse, error) {
 	var stats common.SystemStatsResponse
-	err := n.createRequest(n.client, "GET", "stats/system", &common.Empty{}, &stats)
+	err := n.createRequest(ctx, controller.OpGetSystemStats, n.Timeouts().Unary, "GET", "stats/system", &common.Empty{}, &stats)
 	if err != nil {
 		return nil, err
 	}
@@ -15,8 +22,12 @@ func (n *Node) GetSystemStats() (*common.SystemStatsResponse, error) {
 }
 
 func (n *Node) GetBackendStats() (*common.BackendStatsResponse, error) {
+	return n.GetBackendStatsContext(context.Background())
+}
+
+func (n *Node) GetBackendStatsContext(ctx context.Context) (*common.BackendStatsResponse, error) {
 	var stats common.BackendStatsResponse
-	err := n.createRequest(n.client, "GET", "stats/backend", &common.Empty{}, &stats)
+	err := n.createRequest(ctx, controller.OpGetBackendStats, n.Timeouts().Unary, "GET", "stats/backend", &common.Empty{}, &stats)
 	if err != nil {
 		return nil, err
 	}
@@ -25,8 +36,12 @@ func (n *Node) GetBackendStats() (*common.BackendStatsResponse, error) {
 }
 
 func (n *Node) GetStats(reset bool, name string, statType common.StatType) (*common.StatResponse, error) {
+	return n.GetStatsContext(context.Background(), reset, name, statType)
+}
+
+func (n *Node) GetStatsContext(ctx context.Context, reset bool, name string, statType common.StatType) (*common.StatResponse, error) {
 	var stats common.StatResponse
-	if err := n.createRequest(n.client, "GET", "stats", &common.StatRequest{Reset_: reset, Name: name, Type: statType}, &stats); err != nil {
+	if err := n.createRequest(ctx, controller.OpGetStats, n.Timeouts().Unary, "GET", "stats", &common.StatRequest{Reset_: reset, Name: name, Type: statType}, &stats); err != nil {
 		return nil, err
 	}
 
@@ -34,8 +49,12 @@ func (n *Node) GetStats(reset bool, name string, statType common.StatType) (*com
 }
 
 func (n *Node) GetUserOnlineStat(email string) (*common.OnlineStatResponse, error) {
+	return n.GetUserOnlineStatContext(context.Background(), email)
+}
+
+func (n *Node) GetUserOnlineStatContext(ctx context.Context, email string) (*common.OnlineStatResponse, error) {
 	var stats common.OnlineStatResponse
-	err := n.createRequest(n.client, "GET", "stats/user/online", &common.StatRequest{Name: email}, &stats)
+	err := n.createRequest(ctx, controller.OpGetUserOnlineStat, n.Timeouts().Unary, "GET", "stats/user/online", &common.StatRequest{Name: email}, &stats)
 	if err != nil {
 		return nil, err
 	}
@@ -44,8 +63,12 @@ func (n *Node) GetUserOnlineStat(email string) (*common.OnlineStatResponse, erro
 }
 
 func (n *Node) GetUserOnlineIpList(email string) (*common.StatsOnlineIpListResponse, error) {
+	return n.GetUserOnlineIpListContext(context.Background(), email)
+}
+
+func (n *Node) GetUserOnlineIpListContext(ctx context.Context, email string) (*common.StatsOnlineIpListResponse, error) {
 	var stats common.StatsOnlineIpListResponse
-	err := n.createRequest(n.client, "GET", "stats/user/online_ip", &common.StatRequest{Name: email}, &stats)
+	err := n.createRequest(ctx, controller.OpGetUserOnlineIpList, n.Timeouts().Unary, "GET", "stats/user/online_ip", &common.StatRequest{Name: email}, &stats)
 	if err != nil {
 		return nil, err
 	}
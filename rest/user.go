@@ -1,60 +1,41 @@
 package rest
 
 import (
+	"context"
 	"encoding/binary"
-	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 
 	"github.com/pasarguard/node_bridge/common"
 	"github.com/pasarguard/node_bridge/controller"
+	"github.com/pasarguard/node_bridge/tracing"
 )
 
 func (n *Node) SyncUsers(users []*common.User) error {
+	return n.SyncUsersContext(context.Background(), users)
+}
+
+func (n *Node) SyncUsersContext(ctx context.Context, users []*common.User) error {
+	start := time.Now()
+	err := n.syncUsers(n.TraceSync(ctx, len(users)), users)
+	n.ObserveRequest(controller.OpSyncUsers, start, err)
+	return err
+}
+
+func (n *Node) syncUsers(ctx context.Context, users []*common.User) error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	pr, pw := io.Pipe()
-
-	go func() {
-		defer pw.Close()
-
-		if len(users) == 0 {
-			chunk := &common.UsersChunk{
-				Users: nil,
-				Index: 0,
-				Last:  true,
-			}
-			if err := sendChunk(pw, chunk); err != nil {
-				pw.CloseWithError(err)
-			}
-			return
-		}
-
-		for i := 0; i < len(users); i += controller.MaxChunkSize {
-			end := i + controller.MaxChunkSize
-			if end > len(users) {
-				end = len(users)
-			}
-			chunk := &common.UsersChunk{
-				Users: users[i:end],
-				Index: uint64(i / controller.MaxChunkSize),
-				Last:  end == len(users),
-			}
-			if err := sendChunk(pw, chunk); err != nil {
-				pw.CloseWithError(err)
-				return
-			}
-		}
-	}()
+	body := &chunkBody{ctx: ctx, users: users, size: n.SyncPolicy().ChunkSize}
 
-	req, err := http.NewRequest("PUT", n.baseUrl+"/users/sync/chunked", pr)
+	req, cancel, err := n.newRequest(ctx, n.Timeouts().Sync, "PUT", "users/sync/chunked", body)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("x-api-key", n.ApiKey())
+	defer cancel()
 	req.Header.Set("Content-Type", "application/x-protobuf")
 
 	resp, err := n.client.Do(req)
@@ -64,26 +45,60 @@ func (n *Node) SyncUsers(users []*common.User) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return &StatusError{Code: resp.StatusCode}
 	}
 
 	return nil
 }
 
-func sendChunk(w io.Writer, chunk *common.UsersChunk) error {
-	data, err := proto.Marshal(chunk)
-	if err != nil {
-		return err
+// chunkBody streams users as length-prefixed chunks, encoding each one when
+// the request reads it. A chunk is added to the span of the request as it is
+// read, like the gRPC interceptor does when it is sent.
+type chunkBody struct {
+	ctx   context.Context
+	users []*common.User
+	size  int
+	index int
+	done  bool
+	buf   []byte
+}
+
+func (b *chunkBody) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.done {
+			return 0, io.EOF
+		}
+		if err := b.next(); err != nil {
+			return 0, err
+		}
 	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
 
-	var lenBuf [4]byte
-	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
-	if _, err := w.Write(lenBuf[:]); err != nil {
-		return err
+// next encodes the next chunk, a single empty one if there are no users
+func (b *chunkBody) next() error {
+	start := b.index * b.size
+	end := min(start+b.size, len(b.users))
+	chunk := &common.UsersChunk{
+		Users: b.users[start:end],
+		Index: uint64(b.index),
+		Last:  end == len(b.users),
+	}
+	if len(chunk.Users) == 0 {
+		chunk.Users = nil
 	}
 
-	if _, err := w.Write(data); err != nil {
+	data, err := proto.Marshal(chunk)
+	if err != nil {
 		return err
 	}
+	b.buf = binary.BigEndian.AppendUint32(b.buf, uint32(len(data)))
+	b.buf = append(b.buf, data...)
+
+	tracing.AddCallEvent(b.ctx, tracing.EventChunk, tracing.Int(tracing.KeyChunkIndex, b.index))
+	b.index++
+	b.done = chunk.Last
 	return nil
 }
@@ -15,6 +15,7 @@ import (
 	"github.com/pasarguard/node_bridge/common"
 	"github.com/pasarguard/node_bridge/controller"
 	"github.com/pasarguard/node_bridge/tools"
+	"github.com/pasarguard/node_bridge/tracing"
 )
 
 type Node struct {
@@ -23,41 +24,66 @@ type Node struct {
 	ctx        context.Context
 	cancelFunc context.CancelFunc
 	mu         sync.Mutex
+	// ctxMu guards ctx for the calls made outside mu
+	ctxMu sync.RWMutex
 }
 
-func New(address string, port int, serverCA []byte, apiKey uuid.UUID, logChanSize int, extra map[string]interface{}) (*Node, error) {
+func New(address string, port int, serverCA []byte, apiKey uuid.UUID, logChanSize int, extra map[string]interface{}, opts ...controller.Option) (*Node, error) {
 	certPool, err := tools.LoadClientPool(serverCA)
 	if err != nil {
 		return nil, err
 	}
 
-	creds := credentials.NewClientTLSFromCert(certPool, "")
-	opts := []grpc.DialOption{
-		grpc.WithTransportCredentials(creds),
+	ctx, cancel := createCtxWithMD(apiKey.String())
+
+	n := &Node{
+		Controller: controller.New(apiKey, logChanSize, extra, opts...),
+		ctx:        ctx,
+		cancelFunc: cancel,
 	}
 
 	target := net.JoinHostPort(address, fmt.Sprintf("%d", port))
 
-	client, err := grpc.NewClient(target, opts...)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create gRPC client: %v", err)
+	creds := credentials.NewClientTLSFromCert(certPool, "")
+	dialOpts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+	}
+	if tracer := n.Tracer(); tracer != nil {
+		attrs := []tracing.Attribute{
+			tracing.String(tracing.KeyServerAddress, target),
+			tracing.String(tracing.KeyProtocol, "grpc"),
+		}
+		dialOpts = append(dialOpts,
+			grpc.WithChainUnaryInterceptor(tracing.UnaryClientInterceptor(tracer, attrs...)),
+			grpc.WithChainStreamInterceptor(tracing.StreamClientInterceptor(tracer, attrs...)),
+		)
 	}
 
-	ctx, cancel := createCtxWithMD(apiKey.String())
-
-	n := &Node{
-		Controller: controller.New(apiKey, logChanSize, extra),
-		ctx:        ctx,
-		client:     common.NewNodeServiceClient(client),
-		cancelFunc: cancel,
+	client, err := grpc.NewClient(target, dialOpts...)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create gRPC client: %v", err)
 	}
+	n.client = common.NewNodeServiceClient(client)
 
 	return n, nil
 }
 
 func (n *Node) Start(config string, backendType common.BackendType, users []*common.User, keepAlive uint64) error {
+	return n.StartContext(context.Background(), config, backendType, users, keepAlive)
+}
+
+func (n *Node) StartContext(ctx context.Context, config string, backendType common.BackendType, users []*common.User, keepAlive uint64) error {
+	if err := n.start(ctx, config, backendType, users, keepAlive); err != nil {
+		return err
+	}
+	n.Supervise(config, backendType, users, keepAlive, n.start)
+	return nil
+}
+
+func (n *Node) start(ctx context.Context, config string, backendType common.BackendType, users []*common.User, keepAlive uint64) error {
 	if n.Health() != controller.NotConnected {
-		n.Stop()
+		n.stop(ctx)
 	}
 
 	n.mu.Lock()
@@ -70,44 +96,84 @@ func (n *Node) Start(config string, backendType common.BackendType, users []*com
 		KeepAlive: keepAlive,
 	}
 
-	ctx, cancel := context.WithTimeout(n.ctx, 15*time.Second)
+	callCtx, cancel := n.callCtx(ctx, n.Timeouts().Start)
 	defer cancel()
 
-	info, err := n.client.Start(ctx, req)
+	start := time.Now()
+	info, err := n.client.Start(callCtx, req)
+	n.ObserveRequest(controller.OpStart, start, err)
 	if err != nil {
+		n.ReportError(controller.ReasonStartFailed, err)
+		return err
+	}
+
+	// The start was cancelled, by a Stop during a supervised restart for
+	// instance, so the node must not be left running
+	if err := ctx.Err(); err != nil {
+		stopCtx, cancel := n.callCtx(context.WithoutCancel(ctx), n.Timeouts().Stop)
+		defer cancel()
+		start := time.Now()
+		_, stopErr := n.client.Stop(stopCtx, nil)
+		n.ObserveRequest(controller.OpStop, start, stopErr)
 		return err
 	}
 
 	n.Connect(info.GetNodeVersion(), info.GetCoreVersion())
 
 	n.StartSync(n.ctx, n.SyncUsers)
+	n.StartHealthCheck(n.ctx, keepAlive, n.InfoContext)
+	n.StartReconcile(n.ctx, n.SyncUsersContext)
 
 	return nil
 }
 
 func (n *Node) Stop() {
+	n.StopContext(context.Background())
+}
+
+func (n *Node) StopContext(ctx context.Context) {
+	n.StopSupervisor()
+	n.StopLogStreams()
+	n.stop(ctx)
+}
+
+func (n *Node) stop(ctx context.Context) {
+	// Checked under the lock so a start in progress is waited for
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	if n.Health() == controller.NotConnected {
 		return
 	}
-	n.mu.Lock()
-	defer n.mu.Unlock()
 
 	n.cancelFunc()
 	n.Disconnect()
 
+	n.ctxMu.Lock()
 	n.ctx, n.cancelFunc = createCtxWithMD(n.ApiKey())
+	n.ctxMu.Unlock()
 
-	ctx, cancel := context.WithTimeout(n.ctx, 5*time.Second)
+	ctx, cancel := n.callCtx(ctx, n.Timeouts().Stop)
 	defer cancel()
 
-	_, _ = n.client.Stop(ctx, nil)
+	start := time.Now()
+	_, err := n.client.Stop(ctx, nil)
+	n.ObserveRequest(controller.OpStop, start, err)
+	if err != nil {
+		n.ReportError(controller.ReasonStopFailed, err)
+	}
 }
 
 func (n *Node) Info() (*common.BaseInfoResponse, error) {
-	ctx, cancel := context.WithTimeout(n.ctx, 5*time.Second)
+	return n.InfoContext(context.Background())
+}
+
+func (n *Node) InfoContext(ctx context.Context) (*common.BaseInfoResponse, error) {
+	ctx, cancel := n.callCtx(ctx, n.Timeouts().Unary)
 	defer cancel()
 
+	start := time.Now()
 	resp, err := n.client.GetBaseInfo(ctx, nil)
+	n.ObserveRequest(controller.OpInfo, start, err)
 	if err != nil {
 		return nil, err
 	}
@@ -115,6 +181,33 @@ func (n *Node) Info() (*common.BaseInfoResponse, error) {
 	return resp, nil
 }
 
+// callCtx derives the context of a single call from the caller's one, keeping
+// its deadline, values and outgoing metadata. The api key is attached and the
+// call is cancelled on Stop too. A zero timeout adds no deadline.
+func (n *Node) callCtx(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", n.ApiKey())
+
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	stop := context.AfterFunc(n.lifetime(), cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// lifetime returns the context cancelled on Stop
+func (n *Node) lifetime() context.Context {
+	n.ctxMu.RLock()
+	defer n.ctxMu.RUnlock()
+	return n.ctx
+}
+
 func createCtxWithMD(apiKey string) (context.Context, context.CancelFunc) {
 	md := metadata.Pairs("x-api-key", apiKey)
 	ctxWithKey := metadata.NewOutgoingContext(context.Background(), md)
@@ -2,66 +2,42 @@ package rpc
 
 import (
 	"context"
-	"errors"
+
+	"google.golang.org/grpc"
 
 	"github.com/pasarguard/node_bridge/common"
 	"github.com/pasarguard/node_bridge/controller"
 )
 
-func (n *Node) StreamLogs(ctx context.Context) (<-chan controller.LogEntry, error) {
-	if n.Health() == controller.NotConnected {
-		return nil, errors.New("node not connected")
-	}
-
-	logChan := make(chan controller.LogEntry, n.LogChanSize())
-
-	go func() {
-		defer close(logChan)
-
-		logsStream, err := n.client.GetLogs(n.ctx, &common.Empty{})
-		if err != nil {
-			pushLogEntry(logChan, controller.LogEntry{Err: err})
-			return
-		}
+func (n *Node) StreamLogs(ctx context.Context, opts ...controller.LogStreamOption) (<-chan controller.LogEntry, error) {
+	return n.OpenLogStream(ctx, n.openLogs, opts...)
+}
 
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-n.ctx.Done():
-				return
-			default:
-				logEntry, err := logsStream.Recv()
-				if err != nil {
-					// Only push error if it's not a normal cancellation
-					if ctx.Err() == nil && n.ctx.Err() == nil {
-						pushLogEntry(logChan, controller.LogEntry{Err: err})
-					}
-					return
-				}
-				if logEntry != nil {
-					pushLogEntry(logChan, controller.LogEntry{Line: logEntry.GetDetail()})
-				}
-			}
-		}
-	}()
+// openLogs opens the GetLogs stream, bound to ctx and to the node's lifetime
+func (n *Node) openLogs(ctx context.Context) (controller.LogSource, error) {
+	streamCtx, cancel := n.callCtx(ctx, 0)
+	stream, err := n.client.GetLogs(streamCtx, &common.Empty{})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &logSource{stream: stream, cancel: cancel}, nil
+}
 
-	return logChan, nil
+type logSource struct {
+	stream grpc.ServerStreamingClient[common.Log]
+	cancel context.CancelFunc
 }
 
-func pushLogEntry(ch chan controller.LogEntry, entry controller.LogEntry) {
-	select {
-	case ch <- entry:
-	default:
-		// Drop oldest
-		select {
-		case <-ch:
-		default:
-		}
-		// Non-blocking write to avoid deadlock if channel was emptied between selects
-		select {
-		case ch <- entry:
-		default:
-		}
+func (s *logSource) Recv() (string, error) {
+	log, err := s.stream.Recv()
+	if err != nil {
+		return "", err
 	}
+	return log.GetDetail(), nil
+}
+
+func (s *logSource) Close() error {
+	s.cancel()
+	return nil
 }
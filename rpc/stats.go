@@ -5,13 +5,20 @@ import (
 	"time"
 
 	"github.com/pasarguard/node_bridge/common"
+	"github.com/pasarguard/node_bridge/controller"
 )
 
 func (n *Node) GetSystemStats() (*common.SystemStatsResponse, error) {
-	ctx, cancel := context.WithTimeout(n.ctx, 5*time.Second)
+	return n.GetSystemStatsContext(context.Background())
+}
+
+func (n *Node) GetSystemStatsContext(ctx context.Context) (*common.SystemStatsResponse, error) {
+	ctx, cancel := n.callCtx(ctx, n.Timeouts().Unary)
 	defer cancel()
 
+	start := time.Now()
 	resp, err := n.client.GetSystemStats(ctx, nil)
+	n.ObserveRequest(controller.OpGetSystemStats, start, err)
 	if err != nil {
 		return nil, err
 	}
@@ -20,10 +27,16 @@ func (n *Node) GetSystemStats() (*common.SystemStatsResponse, error) {
 }
 
 func (n *Node) GetBackendStats() (*common.BackendStatsResponse, error) {
-	ctx, cancel := context.WithTimeout(n.ctx, 5*time.Second)
+	return n.GetBackendStatsContext(context.Background())
+}
+
+func (n *Node) GetBackendStatsContext(ctx context.Context) (*common.BackendStatsResponse, error) {
+	ctx, cancel := n.callCtx(ctx, n.Timeouts().Unary)
 	defer cancel()
 
+	start := time.Now()
 	resp, err := n.client.GetBackendStats(ctx, nil)
+	n.ObserveRequest(controller.OpGetBackendStats, start, err)
 	if err != nil {
 		return nil, err
 	}
@@ -32,10 +45,16 @@ func (n *Node) GetBackendStats() (*common.BackendStatsResponse, error) {
 }
 
 func (n *Node) GetStats(reset bool, name string, statType common.StatType) (*common.StatResponse, error) {
-	ctx, cancel := context.WithTimeout(n.ctx, 5*time.Second)
+	return n.GetStatsContext(context.Background(), reset, name, statType)
+}
+
+func (n *Node) GetStatsContext(ctx context.Context, reset bool, name string, statType common.StatType) (*common.StatResponse, error) {
+	ctx, cancel := n.callCtx(ctx, n.Timeouts().Unary)
 	defer cancel()
 
+	start := time.Now()
 	resp, err := n.client.GetStats(ctx, &common.StatRequest{Reset_: reset, Name: name, Type: statType})
+	n.ObserveRequest(controller.OpGetStats, start, err)
 	if err != nil {
 		return nil, err
 	}
@@ -44,10 +63,16 @@ func (n *Node) GetStats(reset bool, name string, statType common.StatType) (*com
 }
 
 func (n *Node) GetUserOnlineStat(email string) (*common.OnlineStatResponse, error) {
-	ctx, cancel := context.WithTimeout(n.ctx, 5*time.Second)
+	return n.GetUserOnlineStatContext(context.Background(), email)
+}
+
+func (n *Node) GetUserOnlineStatContext(ctx context.Context, email string) (*common.OnlineStatResponse, error) {
+	ctx, cancel := n.callCtx(ctx, n.Timeouts().Unary)
 	defer cancel()
 
+	start := time.Now()
 	resp, err := n.client.GetUserOnlineStats(ctx, &common.StatRequest{Name: email})
+	n.ObserveRequest(controller.OpGetUserOnlineStat, start, err)
 	if err != nil {
 		return nil, err
 	}
@@ -56,10 +81,16 @@ func (n *Node) GetUserOnlineStat(email string) (*common.OnlineStatResponse, erro
 }
 
 func (n *Node) GetUserOnlineIpList(email string) (*common.StatsOnlineIpListResponse, error) {
-	ctx, cancel := context.WithTimeout(n.ctx, 5*time.Second)
+	return n.GetUserOnlineIpListContext(context.Background(), email)
+}
+
+func (n *Node) GetUserOnlineIpListContext(ctx context.Context, email string) (*common.StatsOnlineIpListResponse, error) {
+	ctx, cancel := n.callCtx(ctx, n.Timeouts().Unary)
 	defer cancel()
 
+	start := time.Now()
 	resp, err := n.client.GetUserOnlineIpListStats(ctx, &common.StatRequest{Name: email})
+	n.ObserveRequest(controller.OpGetUserOnlineIpList, start, err)
 	if err != nil {
 		return nil, err
 	}
@@ -9,10 +9,21 @@ import (
 )
 
 func (n *Node) SyncUsers(users []*common.User) error {
+	return n.SyncUsersContext(context.Background(), users)
+}
+
+func (n *Node) SyncUsersContext(ctx context.Context, users []*common.User) error {
+	start := time.Now()
+	err := n.syncUsers(n.TraceSync(ctx, len(users)), users)
+	n.ObserveRequest(controller.OpSyncUsers, start, err)
+	return err
+}
+
+func (n *Node) syncUsers(ctx context.Context, users []*common.User) error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	ctx, cancel := context.WithTimeout(n.ctx, 30*time.Second)
+	ctx, cancel := n.callCtx(ctx, n.Timeouts().Sync)
 	defer cancel()
 
 	stream, err := n.client.SyncUsersChunked(ctx)
@@ -20,8 +31,9 @@ func (n *Node) SyncUsers(users []*common.User) error {
 		return err
 	}
 
-	for i := 0; i < len(users); i += controller.MaxChunkSize {
-		end := i + controller.MaxChunkSize
+	chunkSize := n.SyncPolicy().ChunkSize
+	for i := 0; i < len(users); i += chunkSize {
+		end := i + chunkSize
 		if end > len(users) {
 			end = len(users)
 		}
@@ -29,7 +41,7 @@ func (n *Node) SyncUsers(users []*common.User) error {
 
 		err := stream.Send(&common.UsersChunk{
 			Users: chunk,
-			Index: uint64(i / controller.MaxChunkSize),
+			Index: uint64(i / chunkSize),
 			Last:  end == len(users),
 		})
 		if err != nil {
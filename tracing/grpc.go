@@ -0,0 +1,102 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryClientInterceptor traces unary gRPC calls and propagates their span
+// context in the outgoing metadata, next to x-api-key. base is added to every span.
+func UnaryClientInterceptor(tracer Tracer, base ...Attribute) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, span := startSpan(ctx, tracer, method, base, String(KeyMethod, method))
+		defer span.End()
+
+		err := invoker(injectMetadata(ctx, tracer), method, req, reply, cc, opts...)
+		endRPC(span, err)
+		return err
+	}
+}
+
+// StreamClientInterceptor traces gRPC streams until they finish. Sent
+// messages carrying a chunk index are recorded as EventChunk events.
+func StreamClientInterceptor(tracer Tracer, base ...Attribute) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, span := startSpan(ctx, tracer, method, base, String(KeyMethod, method))
+
+		stream, err := streamer(injectMetadata(ctx, tracer), desc, cc, method, opts...)
+		if err != nil {
+			endRPC(span, err)
+			span.End()
+			return nil, err
+		}
+		return &tracedStream{ClientStream: stream, span: span, serverStreams: desc.ServerStreams}, nil
+	}
+}
+
+type chunk interface {
+	GetIndex() uint64
+}
+
+type tracedStream struct {
+	grpc.ClientStream
+	span          Span
+	serverStreams bool
+	once          sync.Once
+}
+
+func (s *tracedStream) SendMsg(m any) error {
+	if c, ok := m.(chunk); ok {
+		s.span.AddEvent(EventChunk, Int(KeyChunkIndex, int(c.GetIndex())))
+	}
+	err := s.ClientStream.SendMsg(m)
+	if err != nil && !errors.Is(err, io.EOF) {
+		s.end(err)
+	}
+	return err
+}
+
+func (s *tracedStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case errors.Is(err, io.EOF):
+		s.end(nil)
+	case err != nil:
+		s.end(err)
+	case !s.serverStreams:
+		// A client stream has a single response
+		s.end(nil)
+	}
+	return err
+}
+
+func (s *tracedStream) end(err error) {
+	s.once.Do(func() {
+		endRPC(s.span, err)
+		s.span.End()
+	})
+}
+
+func endRPC(span Span, err error) {
+	span.SetAttributes(String(KeyStatusCode, status.Code(err).String()))
+	if err != nil {
+		span.RecordError(err)
+	}
+}
+
+func injectMetadata(ctx context.Context, tracer Tracer) context.Context {
+	var kv []string
+	tracer.Inject(ctx, func(key, value string) {
+		kv = append(kv, key, value)
+	})
+	if len(kv) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
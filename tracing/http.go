@@ -0,0 +1,55 @@
+package tracing
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// RoundTripper traces HTTP requests and propagates their span context in the
+// request headers. A span lasts until the response body is closed, so
+// streamed responses are covered in full. base is added to every span and a
+// nil next uses http.DefaultTransport.
+func RoundTripper(tracer Tracer, next http.RoundTripper, base ...Attribute) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &roundTripper{tracer: tracer, next: next, base: base}
+}
+
+type roundTripper struct {
+	tracer Tracer
+	next   http.RoundTripper
+	base   []Attribute
+}
+
+func (t *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	method := req.Method + " " + req.URL.Path
+	ctx, span := startSpan(req.Context(), t.tracer, "HTTP "+method, t.base, String(KeyMethod, method))
+
+	req = req.Clone(ctx)
+	t.tracer.Inject(ctx, req.Header.Set)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.End()
+		return nil, err
+	}
+
+	span.SetAttributes(String(KeyStatusCode, strconv.Itoa(resp.StatusCode)))
+	resp.Body = &tracedBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+type tracedBody struct {
+	io.ReadCloser
+	span Span
+	once sync.Once
+}
+
+func (b *tracedBody) Close() error {
+	b.once.Do(b.span.End)
+	return b.ReadCloser.Close()
+}
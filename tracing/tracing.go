@@ -0,0 +1,113 @@
+// Package tracing traces bridge calls without depending on a tracing SDK.
+// A Tracer adapts the SDK of choice, for example OpenTelemetry, and the gRPC
+// interceptors and HTTP round-tripper of this package start a span for every
+// call and propagate its context to the node. Nothing here runs unless a node
+// is created with a Tracer.
+package tracing
+
+import (
+	"context"
+	"sync"
+)
+
+// Attribute keys set on bridge spans
+const (
+	KeyServerAddress = "server.address"
+	KeyProtocol      = "bridge.protocol"
+	KeyMethod        = "bridge.method"
+	KeyStatusCode    = "bridge.status_code"
+	KeyUserCount     = "bridge.user_count"
+	KeyChunkCount    = "bridge.chunk_count"
+	KeyChunkIndex    = "bridge.chunk_index"
+)
+
+// EventChunk is added to a sync span for every chunk sent
+const EventChunk = "chunk"
+
+// Tracer starts spans and injects the span context of ctx into the outgoing
+// headers of a call, for example as W3C traceparent.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+	Inject(ctx context.Context, set func(key, value string))
+}
+
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	AddEvent(name string, attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+type attributesKey struct{}
+
+// WithAttributes adds attributes to the span of the next call made with ctx
+func WithAttributes(ctx context.Context, attrs ...Attribute) context.Context {
+	existing, _ := ctx.Value(attributesKey{}).([]Attribute)
+	merged := make([]Attribute, 0, len(existing)+len(attrs))
+	merged = append(append(merged, existing...), attrs...)
+	return context.WithValue(ctx, attributesKey{}, merged)
+}
+
+func attributesFrom(ctx context.Context) []Attribute {
+	attrs, _ := ctx.Value(attributesKey{}).([]Attribute)
+	return attrs
+}
+
+type callKey struct{}
+
+// callSpan holds the span of the call made with a context, once started
+type callSpan struct {
+	mu   sync.Mutex
+	span Span
+}
+
+// WithCallEvents lets AddCallEvent reach the span of the next call made with
+// ctx, for code running beside the call such as the writer of a streamed
+// request body.
+func WithCallEvents(ctx context.Context) context.Context {
+	return context.WithValue(ctx, callKey{}, &callSpan{})
+}
+
+// AddCallEvent adds an event to the span of the call made with ctx. It does
+// nothing unless ctx went through WithCallEvents and the span started.
+func AddCallEvent(ctx context.Context, name string, attrs ...Attribute) {
+	call, _ := ctx.Value(callKey{}).(*callSpan)
+	if call == nil {
+		return
+	}
+	call.mu.Lock()
+	defer call.mu.Unlock()
+	if call.span != nil {
+		call.span.AddEvent(name, attrs...)
+	}
+}
+
+// startSpan starts a call span with the base attributes, those added with
+// WithAttributes and extra.
+func startSpan(ctx context.Context, tracer Tracer, name string, base []Attribute, extra ...Attribute) (context.Context, Span) {
+	attrs := make([]Attribute, 0, len(base)+len(extra)+4)
+	attrs = append(attrs, base...)
+	attrs = append(attrs, attributesFrom(ctx)...)
+	attrs = append(attrs, extra...)
+	ctx, span := tracer.Start(ctx, name, attrs...)
+
+	if call, _ := ctx.Value(callKey{}).(*callSpan); call != nil {
+		call.mu.Lock()
+		call.span = span
+		call.mu.Unlock()
+	}
+	return ctx, span
+}
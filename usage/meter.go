@@ -0,0 +1,289 @@
+package usage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pasarguard/node_bridge/common"
+)
+
+// uptimeTolerance absorbs the rounding of the core's uptime to seconds and the
+// latency of reading it
+const uptimeTolerance = 2 * time.Second
+
+// link identifies the uplink or downlink counter of a user email or tag
+type link struct {
+	name string
+	link string
+}
+
+// meter polls the counters of one node. The baselines are the values of the
+// previous read, or zero for the counters reset since.
+type meter struct {
+	a    *Accountant
+	name string
+	node Source
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// mu serializes the polls
+	mu        sync.Mutex
+	baselines map[common.StatType]map[link]int64
+	// resetUnknown holds the stat types whose last reset response was lost
+	resetUnknown map[common.StatType]bool
+	// started is when the core started as of the previous poll
+	started   time.Time
+	lastReset time.Time
+	pending   Usage
+}
+
+func newMeter(a *Accountant, name string, node Source) *meter {
+	ctx, cancel := context.WithCancel(a.ctx)
+	return &meter{
+		a:            a,
+		name:         name,
+		node:         node,
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+		baselines:    make(map[common.StatType]map[link]int64),
+		resetUnknown: make(map[common.StatType]bool),
+		lastReset:    time.Now(),
+		pending:      newUsage(),
+	}
+}
+
+func (m *meter) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.a.options.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := m.poll(m.ctx); err != nil && m.ctx.Err() == nil {
+			m.a.options.logger.Warn("failed to poll traffic", "node", m.name, "error", err)
+		}
+	}
+}
+
+// stop ends the polling loop and polls one last time with ctx
+func (m *meter) stop(ctx context.Context) error {
+	m.cancel()
+	<-m.done
+
+	err := m.poll(ctx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.pending.Empty() {
+		return &UndeliveredError{Node: m.name, Usage: m.pending.clone(), Err: err}
+	}
+	return err
+}
+
+// poll reads the counters, resets them once the reset interval passed, and
+// delivers the traffic not delivered yet
+func (m *meter) poll(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	errs := m.read(ctx)
+	if !m.pending.Empty() {
+		batch := Batch{Node: m.name, Time: time.Now(), Usage: m.pending.clone()}
+		if err := m.a.deliver(ctx, batch); err != nil {
+			errs = append(errs, fmt.Errorf("deliver batch: %w", err))
+		} else {
+			m.pending = newUsage()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// statRead is a response of GetStats waiting to be accounted
+type statRead struct {
+	statType common.StatType
+	resp     *common.StatResponse
+	reset    bool
+}
+
+// read reads the counters between two reads of the core's start time and
+// accounts them only if the core did not restart in between, as they could
+// not be told apart from the counters of the previous run otherwise
+func (m *meter) read(ctx context.Context) []error {
+	started, err := m.coreStarted(ctx)
+	if err != nil {
+		return []error{fmt.Errorf("read uptime: %w", err)}
+	}
+	if m.restartedSince(started) {
+		m.a.options.logger.Info("core restarted, counting traffic from zero", "node", m.name)
+		clear(m.baselines)
+		clear(m.resetUnknown)
+	}
+	if !started.IsZero() {
+		m.started = started
+	}
+
+	reads, errs := m.readCounters(ctx)
+
+	confirmed, err := m.coreStarted(ctx)
+	if err != nil {
+		return append(errs, fmt.Errorf("read uptime: %w", err))
+	}
+	if m.restartedSince(confirmed) {
+		// Accounted from zero by the next poll
+		return append(errs, errors.New("core restarted while reading counters"))
+	}
+
+	for _, r := range reads {
+		m.account(r.statType, r.resp, r.reset)
+	}
+	return errs
+}
+
+// readCounters reads the counters of every stat type. Once the reset interval
+// passed they are reset right after, so that little traffic is at stake if
+// the reset response is lost.
+func (m *meter) readCounters(ctx context.Context) ([]statRead, []error) {
+	reset := m.a.options.resetInterval > 0 && time.Since(m.lastReset) >= m.a.options.resetInterval
+	var (
+		reads []statRead
+		errs  []error
+	)
+	for _, statType := range m.a.options.statTypes {
+		resp, err := m.node.GetStatsContext(ctx, false, "", statType)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("read %s: %w", statType, err))
+			continue
+		}
+		reads = append(reads, statRead{statType: statType, resp: resp})
+		// A reset is not retried before the outcome of the last one is known
+		if !reset || m.resetUnknown[statType] {
+			continue
+		}
+
+		resp, err = m.node.GetStatsContext(ctx, true, "", statType)
+		if err == nil {
+			reads = append(reads, statRead{statType: statType, resp: resp, reset: true})
+			continue
+		}
+		errs = append(errs, fmt.Errorf("reset %s: %w", statType, err))
+		m.resetUnknown[statType] = true
+
+		// Confirms right away whether the counters were reset, while they
+		// had little time to grow past their previous values
+		resp, err = m.node.GetStatsContext(ctx, false, "", statType)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("confirm reset of %s: %w", statType, err))
+			continue
+		}
+		reads = append(reads, statRead{statType: statType, resp: resp})
+	}
+	if reset && len(errs) == 0 {
+		m.lastReset = time.Now()
+	}
+	return reads, errs
+}
+
+// coreStarted returns when the core started according to its uptime, zero if
+// the node does not report it
+func (m *meter) coreStarted(ctx context.Context) (time.Time, error) {
+	stats, err := m.node.GetBackendStatsContext(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if stats.GetUptime() == 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(-time.Duration(stats.GetUptime()) * time.Second), nil
+}
+
+// restartedSince reports whether the core started after the start time seen
+// by the previous poll. The uptime is in seconds, hence the tolerance.
+func (m *meter) restartedSince(started time.Time) bool {
+	return !m.started.IsZero() && !started.IsZero() && started.Sub(m.started) > uptimeTolerance
+}
+
+// account adds the traffic since the previous read of statType to the
+// pending usage. A counter lower than its baseline was reset since, by the
+// last reset or by another client, and counts in full. Only after a lost
+// reset of statType are the counters taken as reset together: one of them
+// decreasing means the reset took effect and every value is new traffic.
+// Only the counters present in resp are compared.
+func (m *meter) account(statType common.StatType, resp *common.StatResponse, reset bool) {
+	baselines := m.baselines[statType]
+	values := make(map[link]int64, len(resp.GetStats()))
+	var errs []error
+	decreased := false
+	for _, stat := range resp.GetStats() {
+		c, err := common.DecodeTrafficCounter(stat, statType)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		key := link{name: c.Name, link: c.Link}
+		if _, ok := values[key]; ok {
+			errs = append(errs, &common.StatError{Stat: stat, Reason: "duplicate counter"})
+			continue
+		}
+		values[key] = c.Value
+		if c.Value < baselines[key] {
+			decreased = true
+		}
+	}
+	allReset := false
+	if m.resetUnknown[statType] && !reset {
+		delete(m.resetUnknown, statType)
+		allReset = decreased
+		if !decreased {
+			m.a.options.logger.Warn("counters did not decrease, assuming the lost reset did not take effect", "node", m.name, "type", statType)
+		}
+	}
+
+	pending := m.pending.byType(statType)
+	for key, value := range values {
+		delta := value
+		if base := baselines[key]; !allReset && value >= base {
+			delta -= base
+		}
+		addPending(pending, key, delta)
+		if reset {
+			values[key] = 0
+		}
+	}
+
+	if len(errs) > 0 {
+		m.a.options.logger.Warn("skipped malformed traffic counters", "node", m.name, "error", errors.Join(errs...))
+		// A skipped counter keeps its baseline, so its next valid read is
+		// not counted in full
+		for key, base := range baselines {
+			if _, ok := values[key]; !ok {
+				if reset || allReset {
+					base = 0
+				}
+				values[key] = base
+			}
+		}
+	}
+	m.baselines[statType] = values
+}
+
+func addPending(pending map[string]Traffic, key link, delta int64) {
+	if delta == 0 {
+		return
+	}
+	t := pending[key.name]
+	if key.link == common.TrafficUplink {
+		t.Uplink += delta
+	} else {
+		t.Downlink += delta
+	}
+	pending[key.name] = t
+}
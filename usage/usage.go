@@ -0,0 +1,299 @@
+// Package usage accounts the traffic of nodes. It polls the traffic counters
+// of every node, turns them into per-user, per-inbound and per-outbound
+// deltas and hands them to a callback, keeping what the callback did not
+// accept for the next batch.
+package usage
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pasarguard/node_bridge/common"
+)
+
+const (
+	DefaultInterval      = 10 * time.Second
+	DefaultResetInterval = 10 * time.Minute
+)
+
+var (
+	ErrNodeExists   = errors.New("node already exists")
+	ErrNodeNotFound = errors.New("node not found")
+	ErrClosed       = errors.New("accountant closed")
+)
+
+// Source reads the traffic counters and the uptime of a node,
+// bridge.PasarGuardNode implements it
+type Source interface {
+	GetStatsContext(ctx context.Context, reset bool, name string, statType common.StatType) (*common.StatResponse, error)
+	GetBackendStatsContext(ctx context.Context) (*common.BackendStatsResponse, error)
+}
+
+// Traffic is an amount of bytes sent to and received from the node's clients
+type Traffic struct {
+	Uplink   int64
+	Downlink int64
+}
+
+func (t Traffic) Total() int64 {
+	return t.Uplink + t.Downlink
+}
+
+// Usage is traffic by user email and by inbound and outbound tag
+type Usage struct {
+	Users     map[string]Traffic
+	Inbounds  map[string]Traffic
+	Outbounds map[string]Traffic
+}
+
+func newUsage() Usage {
+	return Usage{
+		Users:     make(map[string]Traffic),
+		Inbounds:  make(map[string]Traffic),
+		Outbounds: make(map[string]Traffic),
+	}
+}
+
+// Empty reports whether u holds no traffic
+func (u Usage) Empty() bool {
+	return len(u.Users) == 0 && len(u.Inbounds) == 0 && len(u.Outbounds) == 0
+}
+
+// Add adds the traffic of other to u
+func (u Usage) Add(other Usage) {
+	addTraffic(u.Users, other.Users)
+	addTraffic(u.Inbounds, other.Inbounds)
+	addTraffic(u.Outbounds, other.Outbounds)
+}
+
+func addTraffic(dst, src map[string]Traffic) {
+	for name, t := range src {
+		sum := dst[name]
+		sum.Uplink += t.Uplink
+		sum.Downlink += t.Downlink
+		dst[name] = sum
+	}
+}
+
+// byType returns the traffic map filled by statType
+func (u Usage) byType(statType common.StatType) map[string]Traffic {
+	switch statType {
+	case common.StatType_UsersStat, common.StatType_UserStat:
+		return u.Users
+	case common.StatType_Inbounds, common.StatType_Inbound:
+		return u.Inbounds
+	default:
+		return u.Outbounds
+	}
+}
+
+func (u Usage) clone() Usage {
+	c := newUsage()
+	c.Add(u)
+	return c
+}
+
+// Batch is the traffic of a node since the previous batch it accepted
+type Batch struct {
+	Node string
+	Time time.Time
+	Usage
+}
+
+// UndeliveredError holds the traffic of a removed node that the handler did
+// not accept
+type UndeliveredError struct {
+	Node  string
+	Usage Usage
+	Err   error
+}
+
+func (e *UndeliveredError) Error() string {
+	return "undelivered traffic of node " + e.Node + ": " + e.Err.Error()
+}
+
+func (e *UndeliveredError) Unwrap() error {
+	return e.Err
+}
+
+// Handler receives the batches of every node, one at a time. When it fails
+// the traffic of the batch is part of the next batch of the node instead.
+type Handler func(ctx context.Context, batch Batch) error
+
+// Option configures an Accountant
+type Option func(*options)
+
+type options struct {
+	interval      time.Duration
+	resetInterval time.Duration
+	statTypes     []common.StatType
+	logger        *slog.Logger
+}
+
+// WithInterval sets how often the nodes are polled, DefaultInterval by default
+func WithInterval(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.interval = d
+		}
+	}
+}
+
+// WithResetInterval sets how often the counters of a node are reset,
+// DefaultResetInterval by default. Zero or less never resets them.
+func WithResetInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.resetInterval = d
+	}
+}
+
+// WithStatTypes sets the counters to poll among UsersStat, Inbounds and
+// Outbounds, all of them by default
+func WithStatTypes(types ...common.StatType) Option {
+	return func(o *options) {
+		o.statTypes = types
+	}
+}
+
+// WithLogger logs the failed polls and batches to l
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// Accountant polls the traffic counters of its nodes and hands their deltas
+// to a Handler.
+//
+// The counters are read without resetting them and compared to the previous
+// read, so a lost response loses nothing. Every reset interval they are read
+// and then reset right away. A lost reset response is resolved by reading
+// them again at once: counters lower than before mean the reset took effect.
+// Only the traffic between the read and the reset is lost then. Restarts of
+// the core are detected from its uptime, read before and after the counters.
+type Accountant struct {
+	handler Handler
+	options options
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	meters map[string]*meter
+	totals Usage
+	closed bool
+
+	// handlerMu keeps the handler from being called concurrently
+	handlerMu sync.Mutex
+}
+
+// New creates an Accountant handing the traffic of its nodes to handler
+func New(handler Handler, opts ...Option) *Accountant {
+	o := options{
+		interval:      DefaultInterval,
+		resetInterval: DefaultResetInterval,
+		statTypes:     []common.StatType{common.StatType_UsersStat, common.StatType_Inbounds, common.StatType_Outbounds},
+		logger:        slog.New(slog.DiscardHandler),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.logger == nil {
+		o.logger = slog.New(slog.DiscardHandler)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Accountant{
+		handler: handler,
+		options: o,
+		ctx:     ctx,
+		cancel:  cancel,
+		meters:  make(map[string]*meter),
+		totals:  newUsage(),
+	}
+}
+
+// Add starts polling node under name
+func (a *Accountant) Add(name string, node Source) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return ErrClosed
+	}
+	if _, ok := a.meters[name]; ok {
+		return ErrNodeExists
+	}
+	m := newMeter(a, name, node)
+	a.meters[name] = m
+	go m.run()
+	return nil
+}
+
+// Remove stops polling the node and polls it one last time, so the traffic
+// since the previous poll is not lost. Traffic the handler has not accepted
+// by then is returned in an *UndeliveredError.
+func (a *Accountant) Remove(ctx context.Context, name string) error {
+	a.mu.Lock()
+	m, ok := a.meters[name]
+	delete(a.meters, name)
+	a.mu.Unlock()
+
+	if !ok {
+		return ErrNodeNotFound
+	}
+	return m.stop(ctx)
+}
+
+// Poll polls the node right away
+func (a *Accountant) Poll(ctx context.Context, name string) error {
+	a.mu.Lock()
+	m, ok := a.meters[name]
+	a.mu.Unlock()
+
+	if !ok {
+		return ErrNodeNotFound
+	}
+	return m.poll(ctx)
+}
+
+// Totals returns the traffic accepted by the handler so far, summed over the
+// nodes
+func (a *Accountant) Totals() Usage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.totals.clone()
+}
+
+// Close removes every node, see Remove
+func (a *Accountant) Close(ctx context.Context) error {
+	a.mu.Lock()
+	a.closed = true
+	meters := a.meters
+	a.meters = make(map[string]*meter)
+	a.mu.Unlock()
+
+	var errs []error
+	for _, m := range meters {
+		errs = append(errs, m.stop(ctx))
+	}
+	a.cancel()
+	return errors.Join(errs...)
+}
+
+// deliver hands batch to the handler and adds it to the totals once accepted
+func (a *Accountant) deliver(ctx context.Context, batch Batch) error {
+	a.handlerMu.Lock()
+	defer a.handlerMu.Unlock()
+
+	if err := a.handler(ctx, batch); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.totals.Add(batch.Usage)
+	a.mu.Unlock()
+	return nil
+}
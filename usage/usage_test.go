@@ -0,0 +1,401 @@
+package usage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	bridge "github.com/pasarguard/node_bridge"
+	"github.com/pasarguard/node_bridge/common"
+	"github.com/pasarguard/node_bridge/nodetest"
+)
+
+// fakeSource serves counters named like "user>>>alice>>>traffic>>>uplink".
+// With lose set, a call takes effect but its response is lost, with
+// failReset a reset fails without effect. mangle may corrupt the returned
+// stats.
+type fakeSource struct {
+	mu        sync.Mutex
+	counters  map[string]int64
+	started   time.Time
+	lose      bool
+	fail      bool
+	failReset bool
+	mangle    func(*common.Stat)
+}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{counters: make(map[string]int64), started: time.Now().Add(-time.Hour)}
+}
+
+func (s *fakeSource) add(name string, value int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[name] += value
+}
+
+// restart restarts the core, which has been up for a minute since
+func (s *fakeSource) restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.counters)
+	s.started = time.Now().Add(-time.Minute)
+}
+
+func (s *fakeSource) GetBackendStatsContext(context.Context) (*common.BackendStatsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return nil, errors.New("unavailable")
+	}
+	return &common.BackendStatsResponse{Uptime: uint32(time.Since(s.started) / time.Second)}, nil
+}
+
+func (s *fakeSource) GetStatsContext(_ context.Context, reset bool, _ string, statType common.StatType) (*common.StatResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail || (reset && s.failReset) {
+		return nil, errors.New("unavailable")
+	}
+	prefix := map[common.StatType]string{
+		common.StatType_UsersStat: "user>>>",
+		common.StatType_Inbounds:  "inbound>>>",
+		common.StatType_Outbounds: "outbound>>>",
+	}[statType]
+
+	names := make([]string, 0, len(s.counters))
+	for name := range s.counters {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	resp := &common.StatResponse{}
+	for _, name := range names {
+		parts := strings.Split(name, ">>>")
+		stat := &common.Stat{Name: parts[1], Type: parts[0], Link: parts[3], Value: s.counters[name]}
+		if s.mangle != nil {
+			s.mangle(stat)
+		}
+		resp.Stats = append(resp.Stats, stat)
+		if reset {
+			s.counters[name] = 0
+		}
+	}
+	if s.lose {
+		return nil, errors.New("response lost")
+	}
+	return resp, nil
+}
+
+type recorder struct {
+	mu      sync.Mutex
+	batches []Batch
+	fail    bool
+}
+
+func (r *recorder) handle(_ context.Context, batch Batch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail {
+		return errors.New("database down")
+	}
+	r.batches = append(r.batches, batch)
+	return nil
+}
+
+func (r *recorder) last(t *testing.T) Batch {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.batches) == 0 {
+		t.Fatal("no batch delivered")
+	}
+	return r.batches[len(r.batches)-1]
+}
+
+func expectTraffic(t *testing.T, got map[string]Traffic, name string, uplink, downlink int64) {
+	t.Helper()
+	if got[name] != (Traffic{Uplink: uplink, Downlink: downlink}) {
+		t.Fatalf("expected %s to have %d/%d, got %+v", name, uplink, downlink, got[name])
+	}
+}
+
+func TestAccountant(t *testing.T) {
+	source := newFakeSource()
+	rec := &recorder{}
+	a := New(rec.handle, WithInterval(time.Hour), WithResetInterval(0))
+	defer a.Close(context.Background())
+
+	if err := a.Add("node-1", source); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Add("node-1", source); !errors.Is(err, ErrNodeExists) {
+		t.Fatalf("expected ErrNodeExists, got %v", err)
+	}
+	ctx := context.Background()
+
+	source.add("user>>>alice>>>traffic>>>uplink", 100)
+	source.add("user>>>alice>>>traffic>>>downlink", 1000)
+	source.add("inbound>>>vless-in>>>traffic>>>downlink", 1000)
+	if err := a.Poll(ctx, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	batch := rec.last(t)
+	if batch.Node != "node-1" {
+		t.Fatalf("unexpected node %q", batch.Node)
+	}
+	expectTraffic(t, batch.Users, "alice", 100, 1000)
+	expectTraffic(t, batch.Inbounds, "vless-in", 0, 1000)
+
+	// A failed read loses nothing
+	source.add("user>>>alice>>>traffic>>>uplink", 10)
+	source.fail = true
+	if err := a.Poll(ctx, "node-1"); err == nil {
+		t.Fatal("expected the poll to fail")
+	}
+	source.fail = false
+
+	// Nor does a failed handler
+	source.add("user>>>alice>>>traffic>>>uplink", 20)
+	rec.fail = true
+	if err := a.Poll(ctx, "node-1"); err == nil {
+		t.Fatal("expected the delivery to fail")
+	}
+	rec.fail = false
+
+	source.add("user>>>alice>>>traffic>>>uplink", 30)
+	if err := a.Poll(ctx, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	batch = rec.last(t)
+	expectTraffic(t, batch.Users, "alice", 60, 0)
+	if len(batch.Inbounds) != 0 {
+		t.Fatalf("expected no inbound traffic, got %+v", batch.Inbounds)
+	}
+
+	// A restart of the node resets the counters, even those that grew past
+	// their previous value since
+	source.restart()
+	source.add("user>>>alice>>>traffic>>>uplink", 500)
+	if err := a.Poll(ctx, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	expectTraffic(t, rec.last(t).Users, "alice", 500, 0)
+
+	expectTraffic(t, a.Totals().Users, "alice", 660, 1000)
+	expectTraffic(t, a.Totals().Inbounds, "vless-in", 0, 1000)
+}
+
+func TestAccountantMalformed(t *testing.T) {
+	source := newFakeSource()
+	rec := &recorder{}
+	a := New(rec.handle, WithInterval(time.Hour), WithResetInterval(0), WithStatTypes(common.StatType_UsersStat))
+	defer a.Close(context.Background())
+	ctx := context.Background()
+	if err := a.Add("node-1", source); err != nil {
+		t.Fatal(err)
+	}
+
+	addAll := func(value int64) {
+		for _, name := range []string{"a", "b"} {
+			source.add("user>>>"+name+">>>traffic>>>uplink", value)
+			source.add("user>>>"+name+">>>traffic>>>downlink", value)
+		}
+	}
+	addAll(100)
+	source.add("user>>>b>>>traffic>>>uplink", 900)
+	source.add("user>>>b>>>traffic>>>downlink", 900)
+	if err := a.Poll(ctx, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A malformed counter is skipped without taking the others for new ones
+	addAll(10)
+	source.mangle = func(stat *common.Stat) {
+		if stat.Name == "a" && stat.Link == "downlink" {
+			stat.Link = "sideways"
+		}
+	}
+	if err := a.Poll(ctx, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	batch := rec.last(t)
+	expectTraffic(t, batch.Users, "a", 10, 0)
+	expectTraffic(t, batch.Users, "b", 10, 10)
+
+	// and keeps its baseline for its next valid read
+	source.mangle = nil
+	addAll(5)
+	if err := a.Poll(ctx, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	batch = rec.last(t)
+	expectTraffic(t, batch.Users, "a", 5, 15)
+	expectTraffic(t, batch.Users, "b", 5, 5)
+	expectTraffic(t, a.Totals().Users, "a", 115, 115)
+	expectTraffic(t, a.Totals().Users, "b", 1015, 1015)
+}
+
+func TestAccountantPartialReset(t *testing.T) {
+	source := newFakeSource()
+	rec := &recorder{}
+	a := New(rec.handle, WithInterval(time.Hour), WithResetInterval(0), WithStatTypes(common.StatType_UsersStat))
+	defer a.Close(context.Background())
+	ctx := context.Background()
+	if err := a.Add("node-1", source); err != nil {
+		t.Fatal(err)
+	}
+
+	source.add("user>>>alice>>>traffic>>>uplink", 1000)
+	source.add("user>>>bob>>>traffic>>>uplink", 500)
+	if err := a.Poll(ctx, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another client resets the counter of bob alone
+	source.mu.Lock()
+	source.counters["user>>>bob>>>traffic>>>uplink"] = 0
+	source.mu.Unlock()
+	source.add("user>>>alice>>>traffic>>>uplink", 10)
+	source.add("user>>>bob>>>traffic>>>uplink", 20)
+	if err := a.Poll(ctx, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	batch := rec.last(t)
+	expectTraffic(t, batch.Users, "alice", 10, 0)
+	expectTraffic(t, batch.Users, "bob", 20, 0)
+}
+
+func TestAccountantReset(t *testing.T) {
+	source := newFakeSource()
+	rec := &recorder{}
+	a := New(rec.handle, WithInterval(time.Hour), WithResetInterval(time.Nanosecond), WithStatTypes(common.StatType_UsersStat))
+	ctx := context.Background()
+	if err := a.Add("node-1", source); err != nil {
+		t.Fatal(err)
+	}
+
+	source.add("user>>>alice>>>traffic>>>uplink", 100)
+	if err := a.Poll(ctx, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	expectTraffic(t, rec.last(t).Users, "alice", 100, 0)
+	if source.counters["user>>>alice>>>traffic>>>uplink"] != 0 {
+		t.Fatal("expected the counter to be reset")
+	}
+
+	// The reset takes effect but its response is lost
+	source.add("user>>>alice>>>traffic>>>uplink", 50)
+	source.lose = true
+	if err := a.Poll(ctx, "node-1"); err == nil {
+		t.Fatal("expected the poll to fail")
+	}
+	source.lose = false
+
+	source.add("user>>>alice>>>traffic>>>uplink", 7)
+	if err := a.Poll(ctx, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	expectTraffic(t, a.Totals().Users, "alice", 157, 0)
+
+	// The reset fails without effect and the counter grows past its value
+	// before the reset was confirmed
+	source.add("user>>>alice>>>traffic>>>uplink", 1000)
+	if err := a.Poll(ctx, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	source.add("user>>>alice>>>traffic>>>uplink", 100)
+	source.failReset = true
+	if err := a.Poll(ctx, "node-1"); err == nil {
+		t.Fatal("expected the poll to fail")
+	}
+	source.failReset = false
+	source.add("user>>>alice>>>traffic>>>uplink", 2000)
+	if err := a.Poll(ctx, "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	expectTraffic(t, a.Totals().Users, "alice", 3257, 0)
+
+	// Traffic the handler did not accept is handed back on removal
+	source.add("user>>>alice>>>traffic>>>uplink", 3)
+	rec.fail = true
+	var undelivered *UndeliveredError
+	if err := a.Remove(ctx, "node-1"); !errors.As(err, &undelivered) {
+		t.Fatalf("expected an UndeliveredError, got %v", err)
+	}
+	expectTraffic(t, undelivered.Usage.Users, "alice", 3, 0)
+	if err := a.Poll(ctx, "node-1"); !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("expected ErrNodeNotFound, got %v", err)
+	}
+}
+
+func TestAccountantNode(t *testing.T) {
+	for _, protocol := range []bridge.NodeProtocol{bridge.GRPC, bridge.REST} {
+		t.Run(string(protocol), func(t *testing.T) {
+			server, err := nodetest.New(uuid.New())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(server.Close)
+
+			var port int
+			if protocol == bridge.GRPC {
+				port, err = server.ServeGRPC()
+			} else {
+				port, err = server.ServeREST()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			node, err := bridge.New("127.0.0.1", protocol,
+				bridge.WithPort(port),
+				bridge.WithAPIKey(server.APIKey),
+				bridge.WithServerCA(server.CertPEM),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := node.Start("config", common.BackendType_XRAY, nil, 60); err != nil {
+				t.Fatal(err)
+			}
+			defer node.Stop()
+
+			rec := &recorder{}
+			a := New(rec.handle, WithInterval(20*time.Millisecond))
+			if err := a.Add("node-1", node); err != nil {
+				t.Fatal(err)
+			}
+
+			server.AddUserTraffic("alice", 100, 200)
+			server.AddInboundTraffic("vless-in", 100, 200)
+			server.AddOutboundTraffic("direct", 100, 200)
+
+			deadline := time.Now().Add(2 * time.Second)
+			for a.Totals().Users["alice"].Total() == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("timed out waiting for a batch")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			server.AddUserTraffic("alice", 1, 2)
+			if err := a.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			totals := a.Totals()
+			expectTraffic(t, totals.Users, "alice", 101, 202)
+			expectTraffic(t, totals.Inbounds, "vless-in", 100, 200)
+			expectTraffic(t, totals.Outbounds, "direct", 100, 200)
+		})
+	}
+}